@@ -0,0 +1,252 @@
+package stackupdate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// dryRun creates a change set from the same settings UpdateStack would be
+// called with, prints the changes it would make, and deletes it.
+func dryRun(ctx context.Context, svc CloudFormationAPI, input *cloudformation.UpdateStackInput, resources []types.ResourceToImport) error {
+	csInput := changeSetInput(input, "dry-run-"+newToken(""), resources)
+	csInput.Description = ptr("update-cloudformation-stack dry run")
+	out, err := svc.CreateChangeSet(ctx, csInput)
+	if err != nil {
+		return err
+	}
+	changeSetID := unptr(out.Id)
+	defer func() {
+		_, err := svc.DeleteChangeSet(context.WithoutCancel(ctx), &cloudformation.DeleteChangeSetInput{
+			ChangeSetName: &changeSetID,
+			StackName:     input.StackName,
+		})
+		if err != nil {
+			warnf("deleting change set: %v", err)
+		}
+	}()
+	infof("waiting for change set to be created")
+	if err := waitForChangeSet(ctx, svc, changeSetID); err != nil {
+		return err
+	}
+	changes, err := changeSetChanges(ctx, svc, changeSetID)
+	if err != nil {
+		return err
+	}
+	infof("changes to %s stack:", unptr(input.StackName))
+	return printChanges(os.Stdout, changes)
+}
+
+// changeSetInput returns input to create a change set with the same settings
+// UpdateStack would be called with. If resources are set, it's an import
+// change set.
+func changeSetInput(input *cloudformation.UpdateStackInput, name string, resources []types.ResourceToImport) *cloudformation.CreateChangeSetInput {
+	out := &cloudformation.CreateChangeSetInput{
+		StackName:             input.StackName,
+		ChangeSetName:         &name,
+		ChangeSetType:         types.ChangeSetTypeUpdate,
+		UsePreviousTemplate:   input.UsePreviousTemplate,
+		TemplateBody:          input.TemplateBody,
+		TemplateURL:           input.TemplateURL,
+		Parameters:            input.Parameters,
+		Capabilities:          input.Capabilities,
+		NotificationARNs:      input.NotificationARNs,
+		Tags:                  input.Tags,
+		RollbackConfiguration: input.RollbackConfiguration,
+	}
+	if len(resources) != 0 {
+		out.ChangeSetType = types.ChangeSetTypeImport
+		out.ResourcesToImport = resources
+	}
+	return out
+}
+
+// importResources starts the update importing resources into the stack.
+// Resources can only be imported with a change set, which is executed with
+// the client request token of input, so its events are followed the same way
+// as those of UpdateStack call.
+func importResources(ctx context.Context, svc CloudFormationAPI, input *cloudformation.UpdateStackInput, resources []types.ResourceToImport) error {
+	csInput := changeSetInput(input, "import-"+newToken(""), resources)
+	csInput.Description = ptr("update-cloudformation-stack resource import")
+	out, err := svc.CreateChangeSet(ctx, csInput)
+	if err != nil {
+		return err
+	}
+	changeSetID := unptr(out.Id)
+	infof("waiting for import change set to be created")
+	if err := waitForChangeSet(ctx, svc, changeSetID); err != nil {
+		_, derr := svc.DeleteChangeSet(context.WithoutCancel(ctx), &cloudformation.DeleteChangeSetInput{
+			ChangeSetName: &changeSetID,
+			StackName:     input.StackName,
+		})
+		if derr != nil {
+			warnf("deleting change set: %v", derr)
+		}
+		return err
+	}
+	_, err = svc.ExecuteChangeSet(ctx, &cloudformation.ExecuteChangeSetInput{
+		ChangeSetName:      &changeSetID,
+		StackName:          input.StackName,
+		ClientRequestToken: input.ClientRequestToken,
+		DisableRollback:    input.DisableRollback,
+	})
+	return err
+}
+
+// waitForChangeSet polls change set until its creation completes. If change
+// set has no changes, it returns errNoUpdates.
+func waitForChangeSet(ctx context.Context, svc CloudFormationAPI, changeSetID string) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		desc, err := svc.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{ChangeSetName: &changeSetID})
+		if err != nil {
+			return err
+		}
+		debugf("change set status: %v", desc.Status)
+		switch desc.Status {
+		case types.ChangeSetStatusCreateComplete:
+			return nil
+		case types.ChangeSetStatusFailed:
+			reason := unptr(desc.StatusReason)
+			if strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed") {
+				debugf("change set status reason: %s", reason)
+				return errNoUpdates
+			}
+			return fmt.Errorf("change set creation failed: %s", reason)
+		}
+	}
+}
+
+func changeSetChanges(ctx context.Context, svc CloudFormationAPI, changeSetID string) ([]types.Change, error) {
+	var changes []types.Change
+	var nextToken *string
+	for {
+		desc, err := svc.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{
+			ChangeSetName: &changeSetID,
+			NextToken:     nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, desc.Changes...)
+		if nextToken = desc.NextToken; nextToken == nil {
+			return changes, nil
+		}
+	}
+}
+
+// executeChangeSet executes an existing change set of the stack, and waits
+// for the stack update to complete, following events by the token the change
+// set is executed with.
+func executeChangeSet(ctx context.Context, svc CloudFormationAPI, opts Options, stack *types.Stack, changeSet string) error {
+	stackName := unptr(stack.StackName)
+	desc, err := svc.DescribeChangeSet(ctx, &cloudformation.DescribeChangeSetInput{
+		ChangeSetName: &changeSet,
+		StackName:     stack.StackId,
+	})
+	if err != nil {
+		return err
+	}
+	if desc.Status != types.ChangeSetStatusCreateComplete || desc.ExecutionStatus != types.ExecutionStatusAvailable {
+		msg := fmt.Sprintf("change set %s cannot be executed, it is in %v state with %v execution status",
+			unptr(desc.ChangeSetName), desc.Status, desc.ExecutionStatus)
+		if r := unptr(desc.StatusReason); r != "" {
+			msg += ": " + r
+		}
+		return errors.New(msg)
+	}
+	token := cmp.Or(opts.ClientRequestToken, newToken(opts.TokenPrefix))
+	input := &cloudformation.ExecuteChangeSetInput{
+		ChangeSetName:      desc.ChangeSetId,
+		ClientRequestToken: &token,
+	}
+	if opts.NoRollback {
+		input.DisableRollback = ptr(true)
+	}
+	infof("%s: executing change set %s", stackName, unptr(desc.ChangeSetName))
+	started := time.Now()
+	if _, err := svc.ExecuteChangeSet(ctx, input); err != nil {
+		return err
+	}
+	if !opts.Wait {
+		infof("change set execution started, not waiting for it to complete; client request token:")
+		fmt.Println(token)
+		return nil
+	}
+	err = waitForUpdate(ctx, svc, opts, stackName, token, started)
+	if errors.Is(err, errUpdateFailed) && stack.StackId != nil {
+		return fmt.Errorf("%w, see %s for more details", err, consoleURL(opts.Region, *stack.StackId))
+	}
+	return err
+}
+
+// describeChangeSet writes details and changes of an existing change set to
+// w. If changeSet is an ARN, stackName may be empty.
+func describeChangeSet(ctx context.Context, svc CloudFormationAPI, w io.Writer, stackName, changeSet string) error {
+	input := &cloudformation.DescribeChangeSetInput{ChangeSetName: &changeSet}
+	if stackName != "" {
+		input.StackName = &stackName
+	}
+	desc, err := svc.DescribeChangeSet(ctx, input)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Change set:\t%s\n", unptr(desc.ChangeSetName))
+	fmt.Fprintf(tw, "Stack:\t%s\n", unptr(desc.StackName))
+	fmt.Fprintf(tw, "Status:\t%v\n", desc.Status)
+	if r := unptr(desc.StatusReason); r != "" {
+		fmt.Fprintf(tw, "Status reason:\t%s\n", r)
+	}
+	fmt.Fprintf(tw, "Execution status:\t%v\n", desc.ExecutionStatus)
+	if d := unptr(desc.Description); d != "" {
+		fmt.Fprintf(tw, "Description:\t%s\n", d)
+	}
+	if t := unptr(desc.CreationTime); !t.IsZero() {
+		fmt.Fprintf(tw, "Created:\t%s\n", t.UTC().Format(time.RFC3339))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	changes := desc.Changes
+	if desc.NextToken != nil {
+		if changes, err = changeSetChanges(ctx, svc, unptr(desc.ChangeSetId)); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(w)
+	return printChanges(w, changes)
+}
+
+// printChanges writes a table of resource changes to w.
+func printChanges(w io.Writer, changes []types.Change) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tLOGICAL ID\tRESOURCE TYPE\tREPLACEMENT")
+	for _, c := range changes {
+		rc := c.ResourceChange
+		if rc == nil {
+			continue
+		}
+		replacement := string(rc.Replacement)
+		if replacement == "" {
+			replacement = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%s\t%s\t%s\n", rc.Action, unptr(rc.LogicalResourceId), unptr(rc.ResourceType), replacement)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,107 @@
+package stackupdate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// checkDrift runs drift detection on the stack and waits for it to complete.
+// If the stack has drifted, it prints the drifted resources, and returns an
+// error if failOnDrift is set.
+func checkDrift(ctx context.Context, svc CloudFormationAPI, stackName string, failOnDrift bool) error {
+	out, err := svc.DetectStackDrift(ctx, &cloudformation.DetectStackDriftInput{StackName: &stackName})
+	if err != nil {
+		return fmt.Errorf("starting drift detection: %w", err)
+	}
+	infof("%s: detecting stack drift", stackName)
+	status, err := waitForDriftDetection(ctx, svc, unptr(out.StackDriftDetectionId))
+	if err != nil {
+		return err
+	}
+	if status != types.StackDriftStatusDrifted {
+		debugf("%s: stack drift status: %v", stackName, status)
+		return nil
+	}
+	var drifts []types.StackResourceDrift
+	p := cloudformation.NewDescribeStackResourceDriftsPaginator(svc, &cloudformation.DescribeStackResourceDriftsInput{
+		StackName: &stackName,
+		StackResourceDriftStatusFilters: []types.StackResourceDriftStatus{
+			types.StackResourceDriftStatusModified,
+			types.StackResourceDriftStatusDeleted,
+		},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing drifted resources: %w", err)
+		}
+		drifts = append(drifts, page.StackResourceDrifts...)
+	}
+	if failOnDrift {
+		errorf("%s: stack has drifted from its template, drifted resources:", stackName)
+	} else {
+		warnf("%s: stack has drifted from its template, drifted resources:", stackName)
+	}
+	infoBlock(func(w io.Writer) { printDrifts(w, drifts) })
+	if failOnDrift {
+		return fmt.Errorf("stack %s has drifted from its template", stackName)
+	}
+	return nil
+}
+
+// waitForDriftDetection polls drift detection status until it completes,
+// then returns the detected stack drift status.
+func waitForDriftDetection(ctx context.Context, svc CloudFormationAPI, detectionID string) (types.StackDriftStatus, error) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		desc, err := svc.DescribeStackDriftDetectionStatus(ctx, &cloudformation.DescribeStackDriftDetectionStatusInput{
+			StackDriftDetectionId: &detectionID,
+		})
+		if err != nil {
+			return "", err
+		}
+		switch desc.DetectionStatus {
+		case types.StackDriftDetectionStatusDetectionComplete:
+			return desc.StackDriftStatus, nil
+		case types.StackDriftDetectionStatusDetectionFailed:
+			// detection may fail for some resources only, in which case
+			// the result for the rest is still reported
+			if desc.StackDriftStatus == types.StackDriftStatusDrifted {
+				warnf("drift detection did not complete for all resources: %s", unptr(desc.DetectionStatusReason))
+				return desc.StackDriftStatus, nil
+			}
+			return "", fmt.Errorf("drift detection failed: %s", unptr(desc.DetectionStatusReason))
+		}
+	}
+}
+
+// printDrifts writes a table of drifted resources to w.
+func printDrifts(w io.Writer, drifts []types.StackResourceDrift) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOGICAL ID\tRESOURCE TYPE\tDRIFT STATUS\tPROPERTIES")
+	for _, d := range drifts {
+		props := "-"
+		if len(d.PropertyDifferences) != 0 {
+			paths := make([]string, 0, len(d.PropertyDifferences))
+			for _, pd := range d.PropertyDifferences {
+				paths = append(paths, unptr(pd.PropertyPath))
+			}
+			props = strings.Join(paths, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", unptr(d.LogicalResourceId), unptr(d.ResourceType), d.StackResourceDriftStatus, props)
+	}
+	return tw.Flush()
+}
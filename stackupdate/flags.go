@@ -0,0 +1,224 @@
+package stackupdate
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// RegisterFlags defines command line flags setting the fields of o in fs,
+// using the current values of o as defaults.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("stack", "name or ARN of the CloudFormation stack to update; can be repeated or take a comma-separated list", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				o.StackNames = append(o.StackNames, name)
+			}
+		}
+		return nil
+	})
+	fs.BoolVar(&o.OnlyIfChanged, "only-if-changed", o.OnlyIfChanged, "skip the update if all parameters already have the requested values"+
+		" and nothing else is set to change")
+	fs.BoolVar(&o.IfExists, "if-exists", o.IfExists, "if the stack does not exist, warn and exit successfully instead of failing")
+	fs.BoolVar(&o.CreateIfMissing, "create-if-missing", o.CreateIfMissing, "if the stack does not exist, create it from -template-file or -template-url")
+	fs.Func("termination-protection", "turn stack termination protection `on or off`", func(s string) error {
+		switch s {
+		case "on":
+			o.TerminationProtection = ptr(true)
+		case "off":
+			o.TerminationProtection = ptr(false)
+		default:
+			return errors.New("must be either on or off")
+		}
+		return nil
+	})
+	fs.BoolVar(&o.StackSet, "stack-set", o.StackSet, "treat -stack names as names of stack sets, and update their parameters across all stack instances")
+	fs.BoolVar(&o.Parallel, "parallel", o.Parallel, "update multiple stacks concurrently instead of one by one")
+	fs.IntVar(&o.MaxConcurrent, "max-concurrent-stacks", o.MaxConcurrent, "update at most this many stacks at once, implies -parallel; 0 means no limit")
+	fs.StringVar(&o.ParamsFile, "params-file", o.ParamsFile, "`path` to file with newline-separated Key=Value pairs, lines starting with # are ignored;"+
+		" files with .json extension are read as a JSON object; - reads stdin")
+	fs.StringVar(&o.Region, "region", o.Region, "AWS region of the stack; if empty, region is resolved from the environment or shared config")
+	fs.StringVar(&o.Profile, "profile", o.Profile, "named AWS `profile` from the shared config files to use, takes precedence over AWS_PROFILE")
+	fs.Func("param", "parameter in the Key=Value `format` with the value used verbatim, so it can contain any characters,"+
+		" including newlines; can be repeated", func(s string) error {
+		o.LiteralParams = append(o.LiteralParams, s)
+		return nil
+	})
+	fs.StringVar(&o.ParamsFromStack, "parameters-from-stack", o.ParamsFromStack, "`name` of the stack to copy parameter values from;"+
+		" only parameters the updated stack has are copied, and parameters set explicitly take precedence")
+	fs.BoolFunc("set-all-previous", "keep previous values of the parameters not set explicitly (default true);"+
+		" if false, the update fails unless every stack parameter is either set or deleted", func(s string) error {
+		v, err := strconv.ParseBool(s)
+		o.RequireAllParams = !v
+		return err
+	})
+	fs.BoolVar(&o.ExpandEnv, "expand-env", o.ExpandEnv, "expand ${VAR} and $VAR environment variable references in Key=Value parameter values,"+
+		" failing if a variable is not set; use $$ for a literal $; values set with -param are not expanded")
+	fs.BoolVar(&o.AllowEmpty, "allow-empty-values", o.AllowEmpty, "accept parameters with empty values, like Key=, instead of treating them as a mistake")
+	fs.Func("delete-parameter", "`name` of the stack parameter to remove; can be repeated or take a comma-separated list", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				o.ToDelete = append(o.ToDelete, name)
+			}
+		}
+		return nil
+	})
+	fs.Func("allowed-params", "comma-separated `list` of the only parameters allowed to be set or deleted; can be repeated", func(s string) error {
+		if o.AllowedParams == nil {
+			o.AllowedParams = []string{}
+		}
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				o.AllowedParams = append(o.AllowedParams, name)
+			}
+		}
+		return nil
+	})
+	fs.Func("tag", "stack tag in the Key=Value `format` to add or change, with the value taken as is; can be repeated", func(s string) error {
+		o.Tags = append(o.Tags, s)
+		return nil
+	})
+	fs.Func("tag-remove", "`key` of the stack tag to remove; can be repeated", func(s string) error {
+		o.TagsToRemove = append(o.TagsToRemove, s)
+		return nil
+	})
+	fs.Func("capabilities", "comma-separated `list` of capabilities to use instead of the ones the stack currently has", func(s string) error {
+		caps, err := parseCapabilities(s)
+		o.Capabilities = caps
+		return err
+	})
+	fs.Func("notification-arn", "`ARN` of the SNS topic to send stack events to instead of the ones the stack currently uses;"+
+		" can be repeated, empty value clears notifications", func(s string) error {
+		if o.NotificationARNs == nil {
+			o.NotificationARNs = []string{}
+		}
+		if s == "" {
+			return nil
+		}
+		if !isSNSTopicARN(s) {
+			return fmt.Errorf("not an SNS topic ARN: %q", s)
+		}
+		o.NotificationARNs = append(o.NotificationARNs, s)
+		return nil
+	})
+	fs.BoolVar(&o.DropBadNotificationARNs, "drop-bad-notification-arns", o.DropBadNotificationARNs,
+		"if the update is rejected because of notification topics the stack has, e.g. deleted ones, retry it without them")
+	fs.BoolVar(&o.NoRollback, "no-rollback", o.NoRollback, "keep resources in their failed state instead of rolling back if the update fails")
+	fs.Func("on-failure", "what to do if the update fails: `rollback` (default) or do-nothing, same as -no-rollback", func(s string) error {
+		switch s {
+		case "rollback":
+			o.NoRollback = false
+		case "do-nothing":
+			o.NoRollback = true
+		default:
+			return errors.New("must be either rollback or do-nothing")
+		}
+		return nil
+	})
+	fs.Func("rollback-monitoring-minutes", "`minutes` to monitor rollback triggers after the update completes, 0 to 180", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 180 {
+			return errors.New("must be a number from 0 to 180")
+		}
+		o.RollbackMinutes = ptr(int32(n))
+		return nil
+	})
+	fs.Func("rollback-trigger-arn", "`ARN` of the CloudWatch alarm to use as a rollback trigger; can be repeated", func(s string) error {
+		o.RollbackTriggers = append(o.RollbackTriggers, s)
+		return nil
+	})
+	fs.StringVar(&o.ResumeToken, "resume", o.ResumeToken, "instead of starting a new update, wait for the one started with the given client request `token`,"+
+		" e.g. the one printed with -wait=false")
+	fs.StringVar(&o.ExecuteChangeSet, "execute-change-set", o.ExecuteChangeSet, "instead of updating parameters, execute the existing change set"+
+		" of the stack with this `name or ARN`, e.g. one created for a review, and wait for it to complete")
+	fs.StringVar(&o.TokenPrefix, "token-prefix", o.TokenPrefix, "`prefix` of the random client request tokens the tool generates,"+
+		" so that they can be told apart from tokens of other tools")
+	fs.StringVar(&o.ClientRequestToken, "client-request-token", o.ClientRequestToken,
+		"idempotency `token` to use for the UpdateStack call, so that a retried run doesn't start another update; random if empty")
+	fs.BoolVar(&o.Wait, "wait", o.Wait, "wait for the stack update to complete; if false, print the client request token to stdout and exit once update starts")
+	fs.Func("wait-for-status", "comma-separated `list` of stack statuses to treat as success instead of UPDATE_COMPLETE", func(s string) error {
+		known := types.ResourceStatus("").Values()
+		for _, status := range strings.Split(s, ",") {
+			if status = strings.TrimSpace(status); status == "" {
+				continue
+			}
+			if !slices.Contains(known, types.ResourceStatus(status)) {
+				return fmt.Errorf("unknown status %q, valid values are: %v", status, known)
+			}
+			o.WaitForStatus = append(o.WaitForStatus, types.ResourceStatus(status))
+		}
+		return nil
+	})
+	fs.Func("ignore-failure-reason", "`regexp` matching reasons of resource failures caused by other failures, which are not reported as the root cause;"+
+		" can be repeated, replaces the default matching cancelled updates and creations, empty value ignores nothing", func(s string) error {
+		if o.IgnoreFailureReasons == nil {
+			o.IgnoreFailureReasons = []*regexp.Regexp{}
+		}
+		if s == "" {
+			return nil
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		o.IgnoreFailureReasons = append(o.IgnoreFailureReasons, re)
+		return nil
+	})
+	fs.DurationVar(&o.InitialDelay, "initial-delay", o.InitialDelay, "how long to wait after starting the update before polling for stack events")
+	fs.DurationVar(&o.EventsSince, "events-since", o.EventsSince, "how far back to scan stack events, relative to when polling starts")
+	fs.BoolVar(&o.SinceLastOperation, "since-last-operation", o.SinceLastOperation,
+		"scan stack events since the last operation on the stack began, as reported by CloudFormation, instead of using -events-since")
+	fs.DurationVar(&o.PollInterval, "poll-interval", o.PollInterval, "how often to poll for stack events, at least "+minPollInterval.String())
+	fs.BoolVar(&o.OutputJSON, "output-json", o.OutputJSON, "once the update completes, print stack outputs to stdout as a JSON object")
+	fs.StringVar(&o.TemplateFile, "template-file", o.TemplateFile, "`path` to the new stack template; if empty, the current template is reused")
+	fs.StringVar(&o.TemplateURL, "template-url", o.TemplateURL, "`URL` of the new stack template stored in S3, either https:// or s3://bucket/key; cannot be used with -template-file")
+	fs.StringVar(&o.TemplateFromStack, "template-from-stack", o.TemplateFromStack,
+		"`name` of the stack to take the new template from; cannot be used with -template-file or -template-url")
+	fs.StringVar(&o.StackPolicyFile, "stack-policy-file", o.StackPolicyFile, "`path` to the JSON stack policy to set on the stack")
+	fs.StringVar(&o.StackPolicyDuringUpdateFile, "stack-policy-during-update-file", o.StackPolicyDuringUpdateFile,
+		"`path` to the JSON stack policy to temporarily apply during this update only")
+	fs.StringVar(&o.ResourcesToImportFile, "resources-to-import", o.ResourcesToImportFile,
+		"`path` to the JSON list of resources to import into the stack using an import change set; the new template must already declare them")
+	fs.BoolVar(&o.Confirm, "confirm", o.Confirm, "print parameter changes and ask for confirmation before updating each stack;"+
+		" requires an interactive terminal unless -yes is set")
+	fs.BoolVar(&o.Yes, "yes", o.Yes, "answer yes to the -confirm prompt, for running without a terminal")
+	fs.BoolVar(&o.ShowDiff, "show-diff", o.ShowDiff, "print old and new values of the changed parameters before updating the stack")
+	fs.BoolVar(&o.CheckDrift, "check-drift", o.CheckDrift, "detect stack drift before updating and warn about drifted resources")
+	fs.BoolVar(&o.FailOnDrift, "fail-on-drift", o.FailOnDrift, "detect stack drift before updating and abort if the stack has drifted; implies -check-drift")
+	fs.BoolVar(&o.Describe, "describe", o.Describe, "print current stack parameters and exit without updating the stack")
+	fs.StringVar(&o.DescribeEvents, "describe-events", o.DescribeEvents,
+		"print all stack events of the operation started with this client request `token` and exit, e.g. for a token printed with -wait=false")
+	fs.StringVar(&o.DescribeChangeSet, "describe-change-set", o.DescribeChangeSet,
+		"print details and changes of the existing change set with this `name or ARN` and exit; a name needs -stack")
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "create a change set and print the changes it would make instead of updating the stack")
+	fs.StringVar(&o.EndpointURL, "endpoint-url", o.EndpointURL, "custom AWS API endpoint `URL`, e.g. http://localhost:4566 for LocalStack;"+
+		" overrides AWS_ENDPOINT_URL_CLOUDFORMATION environment variable")
+	fs.BoolVar(&o.UseFIPS, "use-fips", o.UseFIPS, "use FIPS endpoints of AWS services; cannot be used with -endpoint-url")
+	fs.BoolVar(&o.DualStack, "dualstack", o.DualStack, "use dual-stack endpoints of AWS services, reachable over IPv6; cannot be used with -endpoint-url")
+	fs.StringVar(&o.RoleARN, "role-arn", o.RoleARN, "`ARN` of the IAM role to assume for CloudFormation API calls")
+	fs.StringVar(&o.RoleSessionName, "role-session-name", o.RoleSessionName, "session `name` to use when assuming the -role-arn role")
+	fs.StringVar(&o.ExternalID, "external-id", o.ExternalID, "external `ID` to use when assuming the -role-arn role")
+	fs.BoolVar(&o.Verbose, "verbose", o.Verbose, "print debug output")
+	fs.BoolVar(&o.Verbose, "v", o.Verbose, "shorthand for -verbose")
+	fs.BoolVar(&o.Quiet, "quiet", o.Quiet, "only print warnings, errors, and final results; cannot be used with -verbose")
+	fs.BoolVar(&o.FollowNested, "follow-nested", o.FollowNested, "also report events of nested stacks updated by the stack update")
+	fs.DurationVar(&o.StallTimeout, "resource-stall-timeout", o.StallTimeout,
+		"warn about resources staying in progress longer than this without new events, 0 to disable")
+	fs.IntVar(&o.MaxAttempts, "max-attempts", o.MaxAttempts, "how many times to try the update if it fails with an error that looks transient,"+
+		" such as a not yet propagated IAM role")
+	fs.DurationVar(&o.Timeout, "timeout", o.Timeout, "maximum time to wait for the stack update to complete, 0 to wait indefinitely")
+	fs.StringVar(&o.EventsFile, "events-file", o.EventsFile, "`path` to the file to append observed stack events to, one JSON object per line")
+	fs.StringVar(&o.Color, "color", o.Color, "color resource statuses in the text log output: `auto`, always, or never;"+
+		" auto enables colors when stderr is a terminal, unless the output format is github")
+	fs.StringVar(&o.EventFormat, "event-format", o.EventFormat, "`template` of stack event lines in the text log output: default, short, long,"+
+		" or a Go text/template with .Time, .Stack, .LogicalID, .PhysicalID, .ResourceType, .Status, and .Reason fields")
+	fs.StringVar(&o.LogFormat, "log-format", o.LogFormat, "log output `format`, either text or json")
+	fs.StringVar(&o.OutputFormat, "output-format", o.OutputFormat, "log output `style`: github for text with GitHub Actions annotations and groups,"+
+		" text, or json; auto picks github under GitHub Actions and text elsewhere, unless -log-format=json is set")
+}
@@ -0,0 +1,322 @@
+package stackupdate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"golang.org/x/term"
+)
+
+// verbose enables debug output outside of GitHub Actions
+var verbose bool
+
+// quiet suppresses progress output, leaving only warnings, errors, and
+// final results
+var quiet bool
+
+// jsonLogger is used instead of the plain text log output if set by
+// setLogFormat
+var jsonLogger *slog.Logger
+
+// useColor enables ANSI colors for resource statuses in text log output
+var useColor bool
+
+// githubLog enables GitHub Actions workflow commands in text log output:
+// annotations for warnings and errors, debug messages, and groups of events
+var githubLog bool
+
+// setOutputFormat configures log output from the -output-format flag value:
+// "github" for text with GitHub Actions workflow commands, "text" for plain
+// text, or "json"; "auto" picks github under GitHub Actions. The -log-format
+// flag value logFormat can select json output too.
+func setOutputFormat(format, logFormat string) error {
+	switch format {
+	case "auto":
+		switch {
+		case logFormat == "json":
+			format = "json"
+		case underGithub:
+			format = "github"
+		default:
+			format = "text"
+		}
+	case "github", "text":
+		if logFormat == "json" {
+			return fmt.Errorf("-log-format=json cannot be used with -output-format=%s", format)
+		}
+	case "json":
+		logFormat = "json"
+	default:
+		return fmt.Errorf("unsupported output format %q, must be one of auto, github, text, json", format)
+	}
+	githubLog = format == "github"
+	githubWarnPrefix, githubErrPrefix = "", ""
+	if githubLog {
+		githubWarnPrefix, githubErrPrefix = "::warning::", "::error::"
+	}
+	return setLogFormat(logFormat)
+}
+
+// setColor configures useColor from the -color flag value: "auto" enables
+// colors when stderr is a terminal and GitHub Actions output is off.
+func setColor(mode string) error {
+	switch mode {
+	case "auto":
+		useColor = !githubLog && term.IsTerminal(int(os.Stderr.Fd()))
+	case "always":
+		useColor = true
+	case "never":
+		useColor = false
+	default:
+		return fmt.Errorf("unsupported color mode %q, must be one of auto, always, never", mode)
+	}
+	return nil
+}
+
+// eventFormats are the named presets of the -event-format flag
+var eventFormats = map[string]string{
+	"default": "{{.ResourceType}}\t{{.LogicalID}}\t{{.Status}}",
+	"short":   "{{.LogicalID}}\t{{.Status}}",
+	"long":    "{{.Time.Format \"15:04:05\"}}\t{{.ResourceType}}\t{{.LogicalID}}\t{{.Status}}\t{{.Reason}}",
+}
+
+// eventTemplate formats stack events in the text log output
+var eventTemplate = template.Must(template.New("event").Parse(eventFormats["default"]))
+
+// eventLine is what eventTemplate is executed with
+type eventLine struct {
+	Time         time.Time
+	Stack        string
+	LogicalID    string
+	PhysicalID   string
+	ResourceType string
+	Status       string // colored if useColor is set
+	Reason       string
+}
+
+// setEventFormat configures eventTemplate from the -event-format flag value,
+// either a preset name or a text/template over eventLine fields.
+func setEventFormat(format string) error {
+	if s, ok := eventFormats[format]; ok {
+		format = s
+	}
+	t, err := template.New("event").Parse(format)
+	if err != nil {
+		return fmt.Errorf("parsing event format: %w", err)
+	}
+	// catch references to unknown fields now rather than on the first event
+	if err := t.Execute(io.Discard, eventLine{}); err != nil {
+		return fmt.Errorf("event format: %w", err)
+	}
+	eventTemplate = t
+	return nil
+}
+
+// formatEvent formats evt with eventTemplate.
+func formatEvent(evt types.StackEvent) string {
+	var b strings.Builder
+	err := eventTemplate.Execute(&b, eventLine{
+		Time:         unptr(evt.Timestamp),
+		Stack:        unptr(evt.StackName),
+		LogicalID:    unptr(evt.LogicalResourceId),
+		PhysicalID:   unptr(evt.PhysicalResourceId),
+		ResourceType: unptr(evt.ResourceType),
+		Status:       coloredStatus(evt.ResourceStatus),
+		Reason:       unptr(evt.ResourceStatusReason),
+	})
+	if err != nil {
+		return fmt.Sprintf("%s\t%s\t%s (formatting event: %v)", unptr(evt.ResourceType), unptr(evt.LogicalResourceId), evt.ResourceStatus, err)
+	}
+	return b.String()
+}
+
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// paint wraps s in the given color if enabled is set.
+func paint(enabled bool, color, s string) string {
+	if !enabled {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// statusColor returns the color for a resource status: red for failures and
+// rollbacks, yellow for operations in progress, green for the rest.
+func statusColor(status types.ResourceStatus) string {
+	switch s := string(status); {
+	case strings.HasSuffix(s, "_FAILED"), strings.Contains(s, "ROLLBACK"):
+		return colorRed
+	case strings.HasSuffix(s, "_IN_PROGRESS"):
+		return colorYellow
+	}
+	return colorGreen
+}
+
+func coloredStatus(status types.ResourceStatus) string {
+	return paint(useColor, statusColor(status), string(status))
+}
+
+// eventsFile, if set, receives a JSON line for each observed stack event
+var eventsFile struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// recordEvents appends events of the stack to eventsFile, if it's set.
+func recordEvents(stackName string, events []types.StackEvent) {
+	eventsFile.Lock()
+	defer eventsFile.Unlock()
+	if eventsFile.w == nil || len(events) == 0 {
+		return
+	}
+	type record struct {
+		Time         time.Time `json:"time"`
+		Stack        string    `json:"stack"`
+		LogicalID    string    `json:"logicalId"`
+		ResourceType string    `json:"resourceType"`
+		Status       string    `json:"status"`
+		Reason       string    `json:"reason,omitempty"`
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, evt := range events {
+		enc.Encode(record{
+			Time:         unptr(evt.Timestamp),
+			Stack:        stackName,
+			LogicalID:    unptr(evt.LogicalResourceId),
+			ResourceType: unptr(evt.ResourceType),
+			Status:       string(evt.ResourceStatus),
+			Reason:       unptr(evt.ResourceStatusReason),
+		})
+	}
+	// single write per poll, so that readers never see partial lines
+	if _, err := eventsFile.w.Write(buf.Bytes()); err != nil {
+		eventsFile.w = nil
+		warnf("writing to events file failed, no more events are written to it: %v", err)
+	}
+}
+
+// setLogFormat switches log output to the given format: "text" (default)
+// or "json".
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		jsonLogger = nil
+	case "json":
+		level := slog.LevelInfo
+		if underGithub || verbose {
+			level = slog.LevelDebug
+		}
+		jsonLogger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	default:
+		return fmt.Errorf("unsupported log format %q, must be either text or json", format)
+	}
+	return nil
+}
+
+func debugf(format string, args ...any) {
+	if jsonLogger != nil {
+		jsonLogger.Debug(fmt.Sprintf(format, args...))
+		return
+	}
+	switch {
+	case githubLog:
+		log.Printf("::debug::"+format, args...)
+	case verbose:
+		log.Printf(format, args...)
+	}
+}
+
+func infof(format string, args ...any) {
+	if quiet {
+		return
+	}
+	resultf(format, args...)
+}
+
+// resultf is like infof, but its output is not suppressed by quiet
+func resultf(format string, args ...any) {
+	if jsonLogger != nil {
+		jsonLogger.Info(fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func warnf(format string, args ...any) {
+	if jsonLogger != nil {
+		jsonLogger.Warn(fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(githubWarnPrefix+format, args...)
+}
+
+func errorf(format string, args ...any) {
+	if jsonLogger != nil {
+		jsonLogger.Error(fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(githubErrPrefix+format, args...)
+}
+
+// logEvents logs stack events. Under GitHub Actions, events are printed in
+// a collapsible group with the given name.
+func logEvents(group string, events []types.StackEvent) {
+	if len(events) == 0 || quiet {
+		return
+	}
+	if githubLog && jsonLogger == nil {
+		log.Print("::group::", group)
+		for _, evt := range events {
+			log.Print(formatEvent(evt))
+		}
+		log.Print("::endgroup::")
+		return
+	}
+	for _, evt := range events {
+		debugEvent(evt)
+	}
+}
+
+// debugEvent logs a single stack event.
+func debugEvent(evt types.StackEvent) {
+	if jsonLogger != nil {
+		jsonLogger.Debug("stack event",
+			"logicalId", unptr(evt.LogicalResourceId),
+			"resourceType", unptr(evt.ResourceType),
+			"status", evt.ResourceStatus,
+			"reason", unptr(evt.ResourceStatusReason),
+		)
+		return
+	}
+	debugf("%s", formatEvent(evt))
+}
+
+// infoBlock logs a multi-line text produced by fn, such as a table. In JSON
+// format, the whole text becomes a message of a single record.
+func infoBlock(fn func(io.Writer)) {
+	if jsonLogger == nil {
+		fn(log.Writer())
+		return
+	}
+	var buf bytes.Buffer
+	fn(&buf)
+	if buf.Len() != 0 {
+		jsonLogger.Info(buf.String())
+	}
+}
@@ -0,0 +1,109 @@
+package stackupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/smithy-go"
+)
+
+// recordEnv is the environment variable naming the file to record responses
+// of CloudFormation API calls to, for use as test fixtures. It's meant for
+// development only, so there is no flag for it.
+const recordEnv = "UPDATE_CLOUDFORMATION_STACK_RECORD"
+
+// fixture holds recorded API responses in the order they were received.
+type fixture struct {
+	Start time.Time     `json:"start"` // when the recording started
+	Calls []fixtureCall `json:"calls"`
+}
+
+type fixtureCall struct {
+	Op     string          `json:"op"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  *fixtureError   `json:"error,omitempty"`
+}
+
+type fixtureError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiRecorder wraps CloudFormationAPI, recording responses of the calls the
+// update and its polling depend on.
+type apiRecorder struct {
+	CloudFormationAPI
+	mu  sync.Mutex
+	fix fixture
+}
+
+func newAPIRecorder(svc CloudFormationAPI) *apiRecorder {
+	return &apiRecorder{CloudFormationAPI: svc, fix: fixture{Start: time.Now().UTC()}}
+}
+
+func (r *apiRecorder) record(op string, out any, err error) {
+	call := fixtureCall{Op: op}
+	if err != nil {
+		call.Error = &fixtureError{Message: err.Error()}
+		var ae smithy.APIError
+		if errors.As(err, &ae) {
+			call.Error.Code, call.Error.Message = ae.ErrorCode(), ae.ErrorMessage()
+		}
+	} else {
+		b, merr := json.Marshal(out)
+		if merr != nil {
+			warnf("recording %s response: %v", op, merr)
+			return
+		}
+		call.Output = b
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fix.Calls = append(r.fix.Calls, call)
+}
+
+// save writes recorded calls to the named file.
+func (r *apiRecorder) save(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, err := json.MarshalIndent(r.fix, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(b, '\n'), 0666)
+}
+
+func (r *apiRecorder) DescribeStacks(ctx context.Context, in *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	out, err := r.CloudFormationAPI.DescribeStacks(ctx, in, optFns...)
+	r.record("DescribeStacks", out, err)
+	return out, err
+}
+
+func (r *apiRecorder) DescribeStackEvents(ctx context.Context, in *cloudformation.DescribeStackEventsInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	out, err := r.CloudFormationAPI.DescribeStackEvents(ctx, in, optFns...)
+	r.record("DescribeStackEvents", out, err)
+	return out, err
+}
+
+func (r *apiRecorder) GetTemplateSummary(ctx context.Context, in *cloudformation.GetTemplateSummaryInput, optFns ...func(*cloudformation.Options)) (*cloudformation.GetTemplateSummaryOutput, error) {
+	out, err := r.CloudFormationAPI.GetTemplateSummary(ctx, in, optFns...)
+	r.record("GetTemplateSummary", out, err)
+	return out, err
+}
+
+func (r *apiRecorder) GetTemplate(ctx context.Context, in *cloudformation.GetTemplateInput, optFns ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error) {
+	out, err := r.CloudFormationAPI.GetTemplate(ctx, in, optFns...)
+	r.record("GetTemplate", out, err)
+	return out, err
+}
+
+func (r *apiRecorder) UpdateStack(ctx context.Context, in *cloudformation.UpdateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	out, err := r.CloudFormationAPI.UpdateStack(ctx, in, optFns...)
+	r.record("UpdateStack", out, err)
+	return out, err
+}
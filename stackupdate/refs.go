@@ -0,0 +1,183 @@
+package stackupdate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// ssmPrefix marks parameter values that are names of SSM Parameter Store
+// parameters to take the actual value from
+const ssmPrefix = "ssm:"
+
+// secretPrefix marks parameter values that are names or ARNs of Secrets
+// Manager secrets, optionally followed by :KEY to take a single field of
+// a JSON secret
+const secretPrefix = "secretsmanager:"
+
+// isRef reports whether v refers to a value stored elsewhere
+func isRef(v string) bool {
+	return strings.HasPrefix(v, ssmPrefix) || strings.HasPrefix(v, secretPrefix)
+}
+
+// resolveRefs replaces values of upd.params listed in upd.refs with the
+// values they refer to. Keys of values that are secret, like those of
+// SecureString SSM parameters, are recorded in upd.secrets.
+func resolveRefs(ctx context.Context, cfg aws.Config, upd *stackUpdate) error {
+	if len(upd.refs) == 0 {
+		return nil
+	}
+	var ssmSvc *ssm.Client
+	var smSvc *secretsmanager.Client
+	for k := range upd.refs {
+		ref := upd.params[k]
+		switch {
+		case strings.HasPrefix(ref, ssmPrefix):
+			if ssmSvc == nil {
+				ssmSvc = ssm.NewFromConfig(cfg)
+			}
+			name := strings.TrimPrefix(ref, ssmPrefix)
+			v, secret, err := ssmParameter(ctx, ssmSvc, name)
+			if err != nil {
+				return fmt.Errorf("resolving value of %q parameter from SSM parameter %q: %w", k, name, err)
+			}
+			upd.params[k] = v
+			if secret {
+				upd.secrets[k] = true
+			}
+		case strings.HasPrefix(ref, secretPrefix):
+			if smSvc == nil {
+				smSvc = secretsmanager.NewFromConfig(cfg)
+			}
+			id, key := parseSecretRef(strings.TrimPrefix(ref, secretPrefix))
+			v, err := secretValue(ctx, smSvc, id, key)
+			if err != nil {
+				return fmt.Errorf("resolving value of %q parameter from secret %q: %w", k, id, err)
+			}
+			upd.params[k] = v
+			upd.secrets[k] = true
+		}
+	}
+	return nil
+}
+
+// ssmParameter returns the value of the named SSM parameter, decrypting it if
+// needed, and whether it is a SecureString.
+func ssmParameter(ctx context.Context, svc *ssm.Client, name string) (string, bool, error) {
+	out, err := svc.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           &name,
+		WithDecryption: ptr(true),
+	})
+	if err != nil {
+		if errors.As(err, new(*ssmtypes.ParameterNotFound)) {
+			return "", false, errors.New("parameter does not exist")
+		}
+		return "", false, err
+	}
+	if out.Parameter == nil || unptr(out.Parameter.Value) == "" {
+		return "", false, errors.New("parameter is empty")
+	}
+	return *out.Parameter.Value, out.Parameter.Type == ssmtypes.ParameterTypeSecureString, nil
+}
+
+// parseSecretRef splits a secret reference into secret id and an optional
+// JSON key. Since secret ARNs contain colons, for them the key is whatever
+// follows the secret name part of the ARN.
+func parseSecretRef(ref string) (id, key string) {
+	if strings.HasPrefix(ref, "arn:") {
+		// arn:partition:secretsmanager:region:account:secret:name
+		if parts := strings.SplitN(ref, ":", 8); len(parts) == 8 {
+			return strings.Join(parts[:7], ":"), parts[7]
+		}
+		return ref, ""
+	}
+	id, key, _ = strings.Cut(ref, ":")
+	return id, key
+}
+
+// secretValue returns the string value of the secret with the given id. If
+// key is not empty, secret is expected to be a JSON object, and the value of
+// its key field is returned.
+func secretValue(ctx context.Context, svc *secretsmanager.Client, id, key string) (string, error) {
+	out, err := svc.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &id})
+	if err != nil {
+		if errors.As(err, new(*smtypes.ResourceNotFoundException)) {
+			return "", errors.New("secret does not exist")
+		}
+		return "", err
+	}
+	if out.SecretString == nil {
+		return "", errors.New("secret has no string value")
+	}
+	if key == "" {
+		if *out.SecretString == "" {
+			return "", errors.New("secret is empty")
+		}
+		return *out.SecretString, nil
+	}
+	return jsonField([]byte(*out.SecretString), key)
+}
+
+// jsonField returns the scalar value of the key field of the JSON object b
+func jsonField(b []byte, key string) (string, error) {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		// don't wrap the error, it may quote parts of the secret
+		return "", errors.New("secret is not a JSON object")
+	}
+	var out string
+	switch v := m[key].(type) {
+	case nil:
+		return "", fmt.Errorf("secret has no %q key", key)
+	case string:
+		out = v
+	case json.Number:
+		out = v.String()
+	case bool:
+		out = fmt.Sprint(v)
+	default:
+		return "", fmt.Errorf("value of %q key of the secret is not a string, number, or boolean", key)
+	}
+	if out == "" {
+		return "", fmt.Errorf("value of %q key of the secret is empty", key)
+	}
+	return out, nil
+}
+
+// presignTemplateURL returns a presigned GET URL for the template referred to
+// by the s3://bucket/key URL, so that templates in buckets requiring signed
+// requests, e.g. encrypted with SSE-KMS, can be used.
+func presignTemplateURL(ctx context.Context, cfg aws.Config, s3URL string, pathStyle bool) (string, error) {
+	u, err := url.Parse(s3URL)
+	if err != nil {
+		return "", err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || bucket == "" || key == "" {
+		return "", fmt.Errorf("template URL must be in the s3://bucket/key form: %q", s3URL)
+	}
+	client := s3.NewPresignClient(s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = pathStyle }))
+	req, err := client.PresignGetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key}, func(o *s3.PresignOptions) {
+		// the URL is used again if the update is retried with
+		// -max-attempts, possibly long after the first attempt
+		o.Expires = 12 * time.Hour
+	})
+	if err != nil {
+		return "", fmt.Errorf("presigning template URL: %w", err)
+	}
+	return req.URL, nil
+}
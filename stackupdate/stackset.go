@@ -0,0 +1,281 @@
+package stackupdate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// stackSetAPI is the part of CloudFormation API the stack sets are updated
+// with, implemented by *cloudformation.Client.
+type stackSetAPI interface {
+	cloudformation.ListStackSetOperationResultsAPIClient
+	DescribeStackSet(context.Context, *cloudformation.DescribeStackSetInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackSetOutput, error)
+	UpdateStackSet(context.Context, *cloudformation.UpdateStackSetInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateStackSetOutput, error)
+	DescribeStackSetOperation(context.Context, *cloudformation.DescribeStackSetOperationInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackSetOperationOutput, error)
+}
+
+// checkStackSetOptions rejects options that only apply to stacks.
+func checkStackSetOptions(opts Options) error {
+	var unsupported []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"-parallel", opts.Parallel || opts.MaxConcurrent > 0},
+		{"-dry-run", opts.DryRun},
+		{"-confirm", opts.Confirm},
+		{"-resume", opts.ResumeToken != ""},
+		{"-execute-change-set", opts.ExecuteChangeSet != ""},
+		{"-only-if-changed", opts.OnlyIfChanged},
+		{"-if-exists", opts.IfExists},
+		{"-create-if-missing", opts.CreateIfMissing},
+		{"-parameters-from-stack", opts.ParamsFromStack != ""},
+		{"-template-from-stack", opts.TemplateFromStack != ""},
+		{"-termination-protection", opts.TerminationProtection != nil},
+		{"-set-all-previous", opts.RequireAllParams},
+		{"-check-drift", opts.CheckDrift || opts.FailOnDrift},
+		{"-show-diff", opts.ShowDiff},
+		{"-wait-for-status", len(opts.WaitForStatus) != 0},
+		{"-since-last-operation", opts.SinceLastOperation},
+		{"-follow-nested", opts.FollowNested},
+		{"-max-attempts", opts.MaxAttempts > 1},
+		{"-resource-stall-timeout", opts.StallTimeout > 0},
+		{"-initial-delay", opts.InitialDelay > 0},
+		{"-notification-arn", opts.NotificationARNs != nil},
+		{"-drop-bad-notification-arns", opts.DropBadNotificationARNs},
+		{"-no-rollback", opts.NoRollback},
+		{"-rollback-monitoring-minutes", opts.RollbackMinutes != nil},
+		{"-rollback-trigger-arn", len(opts.RollbackTriggers) != 0},
+		{"-stack-policy-file", opts.StackPolicyFile != "" || opts.StackPolicyDuringUpdateFile != ""},
+		{"-output-json", opts.OutputJSON},
+		{"-resources-to-import", opts.ResourcesToImportFile != ""},
+	} {
+		if o.set {
+			unsupported = append(unsupported, o.name)
+		}
+	}
+	if len(unsupported) != 0 {
+		return fmt.Errorf("these flags cannot be used with -stack-set: %s", strings.Join(unsupported, ", "))
+	}
+	// client request tokens are used as operation ids, which are stricter:
+	// those must start with a letter
+	if opts.ClientRequestToken != "" && !startsWithLetter(opts.ClientRequestToken) {
+		return errors.New("-client-request-token must start with a letter to be used as a stack set operation id")
+	}
+	if opts.ClientRequestToken == "" && !startsWithLetter(opts.TokenPrefix) {
+		return errors.New("-token-prefix must start with a letter to be used for stack set operation ids")
+	}
+	return nil
+}
+
+func startsWithLetter(s string) bool {
+	return s != "" && ('a' <= s[0] && s[0] <= 'z' || 'A' <= s[0] && s[0] <= 'Z')
+}
+
+// updateStackSets updates all stack sets from opts one by one, each stack set
+// operation updating its stack instances.
+func updateStackSets(ctx context.Context, svc stackSetAPI, opts Options, upd stackUpdate) error {
+	if len(opts.StackNames) == 1 {
+		return updateStackSet(ctx, svc, opts, opts.StackNames[0], upd)
+	}
+	var failed []error
+	for _, name := range opts.StackNames {
+		infof("updating stack set %s", name)
+		if err := updateStackSet(ctx, svc, opts, name, upd); err != nil {
+			resultf("%s: failed: %v", name, err)
+			failed = append(failed, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		resultf("%s: success", name)
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d of %d stack sets failed to update:\n%w", len(failed), len(opts.StackNames), errors.Join(failed...))
+	}
+	return nil
+}
+
+// updateStackSet applies upd to the named stack set, keeping previous values
+// of parameters not set, and waits for the stack set operation to complete.
+func updateStackSet(ctx context.Context, svc stackSetAPI, opts Options, name string, upd stackUpdate) error {
+	desc, err := svc.DescribeStackSet(ctx, &cloudformation.DescribeStackSetInput{StackSetName: &name})
+	if err != nil {
+		return err
+	}
+	set := desc.StackSet
+	if set == nil {
+		return fmt.Errorf("stack set %s not found", name)
+	}
+	if opts.AllowedParams != nil {
+		if err := checkAllowedParams(opts.AllowedParams, upd.params, upd.toDelete); err != nil {
+			return withKind(errUsage, err)
+		}
+	}
+	params, err := stackSetParams(set.Parameters, upd.params, upd.toDelete)
+	if err != nil {
+		return withKind(errUsage, err)
+	}
+	token := cmp.Or(opts.ClientRequestToken, newToken(opts.TokenPrefix))
+	input := &cloudformation.UpdateStackSetInput{
+		StackSetName: &name,
+		OperationId:  &token,
+		Parameters:   params,
+		Capabilities: set.Capabilities,
+		// roles have to be passed again if the stack set uses custom ones
+		AdministrationRoleARN: set.AdministrationRoleARN,
+		ExecutionRoleName:     set.ExecutionRoleName,
+		UsePreviousTemplate:   ptr(true),
+	}
+	if opts.Capabilities != nil {
+		input.Capabilities = opts.Capabilities
+	}
+	if len(upd.tags) != 0 || len(opts.TagsToRemove) != 0 {
+		input.Tags = mergeTags(set.Tags, upd.tags, opts.TagsToRemove)
+	}
+	if upd.templateBody != "" {
+		input.TemplateBody, input.UsePreviousTemplate = &upd.templateBody, nil
+	}
+	if opts.TemplateURL != "" {
+		input.TemplateURL, input.UsePreviousTemplate = &opts.TemplateURL, nil
+	}
+	out, err := svc.UpdateStackSet(ctx, input)
+	if err != nil {
+		return err
+	}
+	opID := cmp.Or(unptr(out.OperationId), token)
+	if !opts.Wait {
+		infof("stack set operation started, not waiting for it to complete; operation id:")
+		fmt.Println(opID)
+		return nil
+	}
+	return waitForStackSetOperation(ctx, svc, opts, name, opID)
+}
+
+// stackSetParams returns parameters to update the stack set with: existing
+// ones keep their previous values unless set or deleted.
+func stackSetParams(existing []types.Parameter, set map[string]string, toDelete map[string]struct{}) ([]types.Parameter, error) {
+	toReplace, toDelete := maps.Clone(set), maps.Clone(toDelete)
+	var out []types.Parameter
+	var valid []string
+	for _, p := range existing {
+		k := unptr(p.ParameterKey)
+		valid = append(valid, k)
+		if _, ok := toDelete[k]; ok {
+			delete(toDelete, k)
+			continue
+		}
+		if v, ok := toReplace[k]; ok {
+			out = append(out, types.Parameter{ParameterKey: &k, ParameterValue: &v})
+			delete(toReplace, k)
+			continue
+		}
+		out = append(out, types.Parameter{ParameterKey: &k, UsePreviousValue: ptr(true)})
+	}
+	if len(toReplace) != 0 {
+		return nil, unknownParamsError("stack set", slices.Collect(maps.Keys(toReplace)), valid)
+	}
+	if len(toDelete) != 0 {
+		return nil, fmt.Errorf("cannot delete parameters the stack set does not have: %s", strings.Join(slices.Sorted(maps.Keys(toDelete)), ", "))
+	}
+	return out, nil
+}
+
+// waitForStackSetOperation polls the stack set operation until it completes,
+// and reports stack instances it failed to update.
+func waitForStackSetOperation(ctx context.Context, svc stackSetAPI, opts Options, name, opID string) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout,
+			withKind(errTimeout, fmt.Errorf("timed out after %v waiting for stack set operation", opts.Timeout)))
+		defer cancel()
+	}
+	infof("polling for %s stack set operation %s until it's done, this may take a while", name, opID)
+	begin := time.Now()
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return fmt.Errorf("%w; stack set operation %s is still in progress in AWS", context.Cause(ctx), opID)
+			}
+		}
+		out, err := svc.DescribeStackSetOperation(ctx, &cloudformation.DescribeStackSetOperationInput{
+			StackSetName: &name,
+			OperationId:  &opID,
+		})
+		if err != nil {
+			if isThrottling(err) {
+				warnf("stack set operation polling was throttled, will retry: %v", err)
+				continue
+			}
+			return err
+		}
+		if out.StackSetOperation == nil {
+			continue
+		}
+		op := out.StackSetOperation
+		switch op.Status {
+		case types.StackSetOperationStatusSucceeded:
+			infof("%s: stack set operation took %v", name, time.Since(begin).Round(time.Second))
+			return nil
+		case types.StackSetOperationStatusFailed, types.StackSetOperationStatusStopped:
+			failures, err := stackSetFailures(ctx, svc, name, opID)
+			if err != nil {
+				warnf("cannot list failed stack instances: %v", err)
+			}
+			infoBlock(func(w io.Writer) { printStackSetFailures(w, failures) })
+			reason := fmt.Sprintf("stack set operation is %v", op.Status)
+			if r := unptr(op.StatusReason); r != "" {
+				reason += ": " + r
+			}
+			return withKind(errUpdateFailed, errors.New(reason))
+		}
+		debugf("%s: stack set operation is %v", name, op.Status)
+	}
+}
+
+// stackSetFailures returns results of the stack set operation for stack
+// instances that failed to update.
+func stackSetFailures(ctx context.Context, svc stackSetAPI, name, opID string) ([]types.StackSetOperationResultSummary, error) {
+	var out []types.StackSetOperationResultSummary
+	p := cloudformation.NewListStackSetOperationResultsPaginator(svc, &cloudformation.ListStackSetOperationResultsInput{
+		StackSetName: &name,
+		OperationId:  &opID,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		for _, r := range page.Summaries {
+			if r.Status == types.StackSetOperationResultStatusFailed {
+				out = append(out, r)
+			}
+		}
+	}
+	return out, nil
+}
+
+func printStackSetFailures(w io.Writer, results []types.StackSetOperationResultSummary) {
+	if len(results) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tREGION\tSTATUS\tREASON")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", unptr(r.Account), unptr(r.Region), r.Status, unptr(r.StatusReason))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,2712 @@
+// Package stackupdate updates CloudFormation stacks by changing some of their
+// parameters while preserving all other settings, and waits for the updates
+// to complete. It implements the update-cloudformation-stack command.
+package stackupdate
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// Options holds settings configured with command line flags, see
+// RegisterFlags.
+type Options struct {
+	StackNames    []string
+	Parallel      bool // update multiple stacks concurrently
+	MaxConcurrent int  // if positive, how many stacks to update at once; implies Parallel
+	StackSet      bool // StackNames are names of stack sets
+	ParamsFile    string
+	TemplateFile  string
+	TemplateURL   string
+	ToDelete      []string // names of parameters to remove from the stack
+	LiteralParams []string // Key=Value pairs with values taken as is
+	AllowEmpty    bool     // accept parameters with empty values
+	ExpandEnv     bool     // expand environment variables in Key=Value pairs
+	AllowedParams []string // if non-nil, only these parameters may be changed
+	Tags          []string // Key=Value pairs of tags to set
+	TagsToRemove  []string
+
+	ParamsFromStack   string // stack to copy parameter values from
+	TemplateFromStack string // stack to take the template from
+
+	RequireAllParams bool // reject updates keeping previous values of any parameters
+
+	StackPolicyFile             string
+	StackPolicyDuringUpdateFile string
+
+	ResourcesToImportFile string // if set, JSON file with resources to import with the update
+
+	Capabilities     []types.Capability // if non-nil, overrides stack capabilities
+	NotificationARNs []string           // if non-nil, overrides stack notification topics
+	NoRollback       bool               // disable rollback on failure
+	RollbackMinutes  *int32             // if non-nil, overrides rollback monitoring time
+	RollbackTriggers []string           // if non-empty, overrides rollback triggers
+
+	DropBadNotificationARNs bool // retry without inherited notification topics the update is rejected for
+
+	Region             string
+	Profile            string
+	EndpointURL        string
+	UseFIPS            bool // use FIPS endpoints
+	DualStack          bool // use dual-stack endpoints, reachable over IPv6
+	Wait               bool
+	ClientRequestToken string                 // if empty, random token is used
+	TokenPrefix        string                 // prefix of random client request tokens
+	ResumeToken        string                 // if set, token of the started update to wait for
+	ExecuteChangeSet   string                 // if set, name or ARN of the change set to execute instead of updating
+	IfExists           bool                   // skip stacks that don't exist
+	OnlyIfChanged      bool                   // skip updates not changing any parameter
+	CreateIfMissing    bool                   // create stacks that don't exist
+	Timeout            time.Duration          // limits how long to poll for stack update
+	WaitForStatus      []types.ResourceStatus // if set, stack statuses to treat as success
+	PollInterval       time.Duration
+	InitialDelay       time.Duration // wait before the first poll
+	EventsSince        time.Duration // how old events may belong to the update
+	SinceLastOperation bool          // scan events since the stack's last operation instead of EventsSince
+	StallTimeout       time.Duration // warn about resources in progress for this long
+	FollowNested       bool          // also poll events of nested stacks
+	MaxAttempts        int           // how many times to try an update failing with a transient error
+	OutputJSON         bool          // print stack outputs as JSON on success
+	DryRun             bool          // only preview changes with a change set
+	Describe           bool          // only print current parameters
+	DescribeEvents     string        // if set, only print events of the operation with this token
+	DescribeChangeSet  string        // if set, only print the change set with this name or ARN
+	CheckDrift         bool          // detect drift before updating
+	FailOnDrift        bool          // abort the update if the stack has drifted
+	ShowDiff           bool          // print parameter changes before updating
+	Confirm            bool          // ask before updating each stack
+	Yes                bool          // assume confirmation was given
+
+	TerminationProtection *bool // if set, termination protection to switch to
+
+	// if set, cancellation of the context is taken for an interrupt: the
+	// stack update is cancelled, and followed until rollback completes;
+	// otherwise the update is left in progress
+	CancelOnInterrupt bool
+
+	// if non-nil, reasons of resource failures caused by other failures,
+	// overriding defaultIgnoredReasons
+	IgnoreFailureReasons []*regexp.Regexp
+
+	RoleARN         string // if set, role to assume with the loaded credentials
+	RoleSessionName string
+	ExternalID      string
+
+	// Parameters are set by UpdateStackParameters, with values taken as is,
+	// like LiteralParams; SSM parameter and secret references are rejected
+	Parameters map[string]string
+
+	// logging options, only used by Main
+	Verbose      bool   // log debug output
+	Quiet        bool   // only log warnings, errors, and final results
+	LogFormat    string // text or json
+	OutputFormat string // auto, github, text, or json
+	Color        string // auto, always, or never
+	EventFormat  string // preset name or text/template for stack events
+	EventsFile   string // path to the file to append stack events to
+}
+
+// DefaultOptions returns Options with the same defaults the command line
+// flags have.
+func DefaultOptions() Options {
+	return Options{
+		Wait:            true,
+		Timeout:         30 * time.Minute,
+		PollInterval:    20 * time.Second,
+		EventsSince:     time.Hour,
+		RoleSessionName: "update-cloudformation-stack",
+		MaxAttempts:     1,
+		TokenPrefix:     defaultTokenPrefix,
+		LogFormat:       "text",
+		OutputFormat:    "auto",
+		Color:           "auto",
+		EventFormat:     "default",
+	}
+}
+
+// clockSkew is the allowed difference between local and AWS clocks when
+// comparing event timestamps.
+const clockSkew = time.Minute
+
+// minPollInterval is the shortest allowed interval between stack events
+// polls, to avoid hitting API rate limits.
+const minPollInterval = 5 * time.Second
+
+// Exit codes for different kinds of failures.
+const (
+	exitFailure      = 1 // any failure not covered by other codes
+	exitUpdateFailed = 2 // stack update failed or was rolled back
+	exitTimeout      = 3 // timed out waiting for stack update
+	exitUsage        = 4 // invalid flags or parameters
+	exitInterrupted  = 5 // gave up waiting on interrupt or deadline
+)
+
+// Errors of these kinds are mapped to specific exit codes, see exitCode.
+var (
+	errUpdateFailed = errors.New("stack update failed")
+	errTimeout      = errors.New("timeout")
+	errUsage        = errors.New("invalid usage")
+	errInterrupted  = errors.New("interrupted")
+)
+
+// withKind marks err as being of the kind, which is one of the sentinel
+// errors, so that errors.Is(err, kind) reports true. Error message is kept
+// as is.
+func withKind(kind, err error) error {
+	return &kindError{err: err, kind: kind}
+}
+
+type kindError struct{ err, kind error }
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.err, e.kind} }
+
+// exitCode returns the process exit code to use for err.
+func exitCode(err error) int {
+	switch {
+	case err == nil, isNoUpdates(err):
+		return 0
+	case errors.Is(err, errUpdateFailed):
+		return exitUpdateFailed
+	case errors.Is(err, errTimeout):
+		return exitTimeout
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errInterrupted), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return exitInterrupted
+	}
+	return exitFailure
+}
+
+// errNoUpdates is returned when stack has nothing to change.
+var errNoUpdates = errors.New("no updates are to be performed")
+
+// isNoUpdates reports whether err signals that the stack has nothing to
+// change.
+func isNoUpdates(err error) bool {
+	if errors.Is(err, errNoUpdates) {
+		return true
+	}
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "ValidationError" && ae.ErrorMessage() == "No updates are to be performed."
+}
+
+// errStackMissing is returned for stacks that don't exist when run with
+// -if-exists.
+var errStackMissing = errors.New("stack does not exist")
+
+// isStackMissing reports whether err is the DescribeStacks error for a stack
+// that does not exist.
+func isStackMissing(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "ValidationError" && strings.Contains(ae.ErrorMessage(), "does not exist")
+}
+
+// stackMissingError replaces err with a clearer one if it's the API error for
+// a stack that does not exist, which is most often a typo in the stack name
+// or a wrong region.
+func stackMissingError(err error, stackName, region string) error {
+	if !isStackMissing(err) {
+		return err
+	}
+	return fmt.Errorf("stack %q does not exist in region %s", stackName, region)
+}
+
+// capabilitiesError replaces err with one telling which -capabilities flag to
+// use if it's the API error for a template requiring capabilities other than
+// have. Capabilities are copied from the stack, so a template change adding
+// IAM resources fails this way.
+func capabilitiesError(err error, have []types.Capability) error {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) || ae.ErrorCode() != "InsufficientCapabilitiesException" {
+		return err
+	}
+	caps := slices.Clone(have)
+	for _, c := range capabilityRe.FindAllString(ae.ErrorMessage(), -1) {
+		if !slices.Contains(caps, types.Capability(c)) {
+			caps = append(caps, types.Capability(c))
+		}
+	}
+	if len(caps) == len(have) {
+		return err
+	}
+	list := make([]string, len(caps))
+	for i, c := range caps {
+		list[i] = string(c)
+	}
+	return withKind(errUsage, fmt.Errorf("%w; the template needs more capabilities than the stack has,"+
+		" run with -capabilities=%s", err, strings.Join(list, ",")))
+}
+
+var capabilityRe = regexp.MustCompile(`CAPABILITY_[A-Z_]+`)
+
+// isThrottling reports whether err is an API rate limiting error.
+func isThrottling(err error) bool {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.ErrorCode() {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+	return false
+}
+
+// ExitUsage is the exit code for invalid flags or parameters.
+const ExitUsage = exitUsage
+
+// Main runs the command line tool with opts and positional arguments args,
+// logging the outcome, and returns the process exit code.
+func Main(ctx context.Context, opts Options, args []string) int {
+	closeLog, err := setupLogging(opts)
+	if err != nil {
+		errorf("%v", err)
+		return exitUsage
+	}
+	defer closeLog()
+	if err := run(ctx, opts, args); err != nil {
+		if isNoUpdates(err) {
+			debugf("error: %v", err)
+			warnf("nothing to update")
+			return 0
+		}
+		errorf("%v", err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// Result is the outcome of UpdateStackParameters.
+type Result struct {
+	Updated bool              // false if there was nothing to update
+	Status  types.StackStatus // final stack status
+	Outputs map[string]string // stack outputs by their keys
+}
+
+// UpdateStackParameters updates the single stack from opts with
+// opts.Parameters, keeping previous values of other parameters, and waits
+// for the update to complete, the same way the command line tool does.
+// Unlike on the command line, parameter values are never read from files or
+// the environment, so opts.ParamsFile and opts.ExpandEnv cannot be used, and
+// values referring to SSM parameters or secrets are rejected rather than
+// resolved: callers are expected to resolve them. opts.TemplateURL must be an
+// https:// URL.
+// If opts.Region is empty, it's taken from client options, which requires
+// client to be a *cloudformation.Client.
+//
+// If the update was started, but failed, both Result and the error are
+// returned. Logging options of opts are ignored: logging is set up for the
+// whole process by Main only, and is plain text to stderr otherwise. It is
+// safe to call UpdateStackParameters from multiple goroutines.
+func UpdateStackParameters(ctx context.Context, client CloudFormationAPI, opts Options) (*Result, error) {
+	if len(opts.StackNames) != 1 {
+		return nil, withKind(errUsage, errors.New("exactly one stack must be set"))
+	}
+	if !opts.Wait || opts.DryRun || opts.Describe || opts.DescribeEvents != "" || opts.DescribeChangeSet != "" {
+		return nil, withKind(errUsage, errors.New("UpdateStackParameters always waits for the update, and cannot preview or describe stacks"))
+	}
+	if opts.ParamsFile != "" || opts.ExpandEnv {
+		return nil, withKind(errUsage, errors.New("UpdateStackParameters takes parameter values as is, and cannot read them from a file or expand environment variables"))
+	}
+	for _, k := range slices.Sorted(maps.Keys(opts.Parameters)) {
+		if isRef(opts.Parameters[k]) {
+			return nil, withKind(errUsage, fmt.Errorf("value of %q parameter refers to an SSM parameter or a secret,"+
+				" which UpdateStackParameters does not resolve: %q", k, opts.Parameters[k]))
+		}
+	}
+	for _, kv := range opts.LiteralParams {
+		if k, v, _ := strings.Cut(kv, "="); isRef(v) {
+			return nil, withKind(errUsage, fmt.Errorf("value of %q parameter refers to an SSM parameter or a secret,"+
+				" which UpdateStackParameters does not resolve: %q", k, v))
+		}
+	}
+	if strings.HasPrefix(opts.TemplateURL, "s3://") {
+		return nil, withKind(errUsage, errors.New("template URL must be an https:// URL of the S3 object, s3:// URLs are only supported on the command line"))
+	}
+	if opts.Region == "" {
+		if c, ok := client.(interface{ Options() cloudformation.Options }); ok {
+			opts.Region = c.Options().Region
+		}
+	}
+	if opts.Region == "" {
+		return nil, withKind(errUsage, errors.New("region must be set, either in options or in the client"))
+	}
+	opts.LiteralParams = slices.Clip(opts.LiteralParams)
+	for _, k := range slices.Sorted(maps.Keys(opts.Parameters)) {
+		opts.LiteralParams = append(opts.LiteralParams, k+"="+opts.Parameters[k])
+	}
+	upd, err := prepareUpdate(opts, nil)
+	if err != nil {
+		return nil, withKind(errUsage, err)
+	}
+	if opts.TemplateFromStack != "" {
+		if upd.templateBody, err = stackTemplate(ctx, client, opts.TemplateFromStack); err != nil {
+			return nil, err
+		}
+	}
+	stackName := opts.StackNames[0]
+	rec := &updateRecorder{CloudFormationAPI: client}
+	err = updateStack(ctx, rec, opts, stackName, upd)
+	switch {
+	case isNoUpdates(err):
+		err = nil
+	case errors.Is(err, errStackMissing):
+		return nil, err
+	case err != nil && !rec.started:
+		return nil, err
+	}
+	stack, derr := describeStack(context.WithoutCancel(ctx), client, stackName)
+	if derr != nil {
+		return nil, cmp.Or(err, derr)
+	}
+	res := &Result{Updated: rec.started, Status: stack.StackStatus, Outputs: make(map[string]string, len(stack.Outputs))}
+	for _, o := range stack.Outputs {
+		res.Outputs[unptr(o.OutputKey)] = unptr(o.OutputValue)
+	}
+	return res, err
+}
+
+// setupLogging configures process-wide logging as set in opts. The returned
+// function stops recording events to opts.EventsFile.
+func setupLogging(opts Options) (func(), error) {
+	verbose, quiet = opts.Verbose, opts.Quiet
+	if quiet && verbose {
+		return nil, errors.New("-quiet and -verbose cannot be used together")
+	}
+	if err := setOutputFormat(cmp.Or(opts.OutputFormat, "auto"), cmp.Or(opts.LogFormat, "text")); err != nil {
+		return nil, err
+	}
+	if err := setColor(cmp.Or(opts.Color, "auto")); err != nil {
+		return nil, err
+	}
+	if err := setEventFormat(cmp.Or(opts.EventFormat, "default")); err != nil {
+		return nil, err
+	}
+	if opts.EventsFile == "" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(opts.EventsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	eventsFile.Lock()
+	eventsFile.w = f
+	eventsFile.Unlock()
+	return func() {
+		eventsFile.Lock()
+		eventsFile.w = nil
+		eventsFile.Unlock()
+		f.Close()
+	}, nil
+}
+
+func run(ctx context.Context, opts Options, args []string) error {
+	if opts.DescribeChangeSet != "" {
+		if len(opts.StackNames) > 1 || opts.Describe || opts.DescribeEvents != "" {
+			return withKind(errUsage, errors.New("-describe-change-set can only be used with at most one stack, and without -describe or -describe-events"))
+		}
+		if len(opts.StackNames) == 0 && !strings.HasPrefix(opts.DescribeChangeSet, "arn:") {
+			return withKind(errUsage, errors.New("-describe-change-set needs -stack, unless the change set is given by its ARN"))
+		}
+		cfg, err := loadConfig(ctx, opts)
+		if err != nil {
+			return err
+		}
+		var name string
+		if len(opts.StackNames) != 0 {
+			name = opts.StackNames[0]
+		}
+		return describeChangeSet(ctx, newClient(cfg, opts), os.Stdout, name, opts.DescribeChangeSet)
+	}
+	if opts.DescribeEvents != "" {
+		if len(opts.StackNames) != 1 || opts.Describe {
+			return withKind(errUsage, errors.New("-describe-events can only be used with a single stack, and without -describe"))
+		}
+		cfg, err := loadConfig(ctx, opts)
+		if err != nil {
+			return err
+		}
+		name := opts.StackNames[0]
+		if err := describeEvents(ctx, newClient(cfg, opts), os.Stdout, name, opts.DescribeEvents); err != nil {
+			return stackMissingError(err, name, cfg.Region)
+		}
+		return nil
+	}
+	if opts.Describe {
+		if len(opts.StackNames) == 0 {
+			return withKind(errUsage, errors.New("stack name must be set"))
+		}
+		cfg, err := loadConfig(ctx, opts)
+		if err != nil {
+			return err
+		}
+		svc := newClient(cfg, opts)
+		for _, name := range opts.StackNames {
+			if err := describeParams(ctx, svc, name, len(opts.StackNames) > 1); err != nil {
+				return stackMissingError(err, name, cfg.Region)
+			}
+		}
+		return nil
+	}
+	if underGithub && len(args) == 0 {
+		var err error
+		if args, err = inputParams(os.Getenv("INPUT_PARAMETERS")); err != nil {
+			return withKind(errUsage, err)
+		}
+	}
+	upd, err := prepareUpdate(opts, args)
+	if err != nil {
+		return withKind(errUsage, err)
+	}
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := resolveRefs(ctx, cfg, &upd); err != nil {
+		return err
+	}
+	if strings.HasPrefix(opts.TemplateURL, "s3://") {
+		if opts.TemplateURL, err = presignTemplateURL(ctx, cfg, opts.TemplateURL, opts.EndpointURL != ""); err != nil {
+			return withKind(errUsage, err)
+		}
+	}
+	if opts.StackSet {
+		return updateStackSets(ctx, newClient(cfg, opts), opts, upd)
+	}
+	// region may come from the environment or shared config
+	opts.Region = cfg.Region
+	if name := os.Getenv(recordEnv); name != "" {
+		rec := newAPIRecorder(newClient(cfg, opts))
+		defer func() {
+			if err := rec.save(name); err != nil {
+				warnf("saving recorded API calls: %v", err)
+			}
+		}()
+		return deploy(ctx, rec, opts, upd)
+	}
+	return deploy(ctx, newClient(cfg, opts), opts, upd)
+}
+
+// deploy applies upd to the stacks from opts. For a single stack, it then
+// reports stack outputs as requested by opts.
+func deploy(ctx context.Context, svc CloudFormationAPI, opts Options, upd stackUpdate) error {
+	if opts.TemplateFromStack != "" {
+		var err error
+		if upd.templateBody, err = stackTemplate(ctx, svc, opts.TemplateFromStack); err != nil {
+			return stackMissingError(err, opts.TemplateFromStack, opts.Region)
+		}
+	}
+	if len(opts.StackNames) > 1 {
+		return updateStacks(ctx, svc, opts, upd)
+	}
+	stackName := opts.StackNames[0]
+	rec := &updateRecorder{CloudFormationAPI: svc}
+	err := updateStack(ctx, rec, opts, stackName, upd)
+	if errors.Is(err, errStackMissing) {
+		warnf("stack %s does not exist, nothing to update", stackName)
+		return nil
+	}
+	if opts.DryRun || !opts.Wait {
+		return err
+	}
+	ghOutput := os.Getenv("GITHUB_OUTPUT")
+	withOutputs := underGithub && ghOutput != ""
+	if err != nil && !isNoUpdates(err) {
+		// status is saved on failure too, for steps that run after
+		// a failed deployment
+		if withOutputs {
+			if stack, err := describeStack(context.WithoutCancel(ctx), svc, stackName); err != nil {
+				warnf("cannot save stack status: %v", err)
+			} else if err := writeGithubOutputs(ghOutput, updateOutputs(rec.started, stack.StackStatus)); err != nil {
+				warnf("saving stack status: %v", err)
+			}
+		}
+		return err
+	}
+	// with nothing to update, stack outputs are still reported, so that
+	// steps using them work the same on reruns
+	if !opts.OutputJSON && !withOutputs {
+		return err
+	}
+	stack, derr := describeStack(ctx, svc, stackName)
+	if derr != nil {
+		return derr
+	}
+	if withOutputs {
+		// written last, so these take precedence over stack outputs
+		// with the same names
+		outputs := append(slices.Clip(stack.Outputs), updateOutputs(rec.started, stack.StackStatus)...)
+		if err := writeGithubOutputs(ghOutput, outputs); err != nil {
+			return fmt.Errorf("saving stack outputs: %w", err)
+		}
+	}
+	if opts.OutputJSON {
+		if err := printOutputs(os.Stdout, stack.Outputs); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// updateRecorder records whether a stack update or creation was started
+// through it.
+type updateRecorder struct {
+	CloudFormationAPI
+	started bool
+}
+
+func (r *updateRecorder) UpdateStack(ctx context.Context, in *cloudformation.UpdateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	out, err := r.CloudFormationAPI.UpdateStack(ctx, in, optFns...)
+	if err == nil {
+		r.started = true
+	}
+	return out, err
+}
+
+func (r *updateRecorder) CreateStack(ctx context.Context, in *cloudformation.CreateStackInput, optFns ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error) {
+	out, err := r.CloudFormationAPI.CreateStack(ctx, in, optFns...)
+	if err == nil {
+		r.started = true
+	}
+	return out, err
+}
+
+func (r *updateRecorder) ExecuteChangeSet(ctx context.Context, in *cloudformation.ExecuteChangeSetInput, optFns ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error) {
+	out, err := r.CloudFormationAPI.ExecuteChangeSet(ctx, in, optFns...)
+	if err == nil {
+		r.started = true
+	}
+	return out, err
+}
+
+// updateOutputs returns step outputs telling whether the stack update was
+// started, and the status the stack ended up in.
+func updateOutputs(started bool, status types.StackStatus) []types.Output {
+	return []types.Output{
+		{OutputKey: ptr("updated"), OutputValue: ptr(strconv.FormatBool(started))},
+		{OutputKey: ptr("status"), OutputValue: ptr(string(status))},
+	}
+}
+
+// prepareUpdate validates opts and loads changes to apply to the stacks from
+// args and files referenced by opts.
+func prepareUpdate(opts Options, args []string) (stackUpdate, error) {
+	var upd stackUpdate
+	if len(opts.StackNames) == 0 {
+		return upd, errors.New("stack name must be set")
+	}
+	if len(opts.StackNames) > 1 && (opts.OutputJSON || !opts.Wait) {
+		return upd, errors.New("-output-json and -wait=false can only be used with a single stack")
+	}
+	if opts.MaxConcurrent < 0 {
+		return upd, errors.New("-max-concurrent-stacks cannot be negative")
+	}
+	if opts.MaxAttempts < 1 {
+		return upd, errors.New("-max-attempts must be at least 1")
+	}
+	if opts.PollInterval < minPollInterval {
+		return upd, fmt.Errorf("poll interval must be at least %v", minPollInterval)
+	}
+	var templates int
+	for _, s := range []string{opts.TemplateFile, opts.TemplateURL, opts.TemplateFromStack} {
+		if s != "" {
+			templates++
+		}
+	}
+	if templates > 1 {
+		return upd, errors.New("only one of -template-file, -template-url, and -template-from-stack can be set")
+	}
+	if opts.CreateIfMissing && templates == 0 {
+		return upd, errors.New("-create-if-missing requires either -template-file, -template-url, or -template-from-stack")
+	}
+	if opts.CreateIfMissing && opts.IfExists {
+		return upd, errors.New("-create-if-missing and -if-exists cannot be used together")
+	}
+	if opts.Confirm && !opts.Yes {
+		if underGithub || !term.IsTerminal(int(os.Stdin.Fd())) {
+			return upd, errors.New("-confirm needs an interactive terminal, use -yes to proceed without confirmation")
+		}
+		if (opts.Parallel || opts.MaxConcurrent > 1) && len(opts.StackNames) > 1 {
+			return upd, errors.New("-confirm cannot be used with -parallel")
+		}
+	}
+	if opts.ResourcesToImportFile != "" {
+		if templates == 0 {
+			return upd, errors.New("-resources-to-import requires either -template-file, -template-url, or -template-from-stack")
+		}
+		if len(opts.StackNames) != 1 || opts.CreateIfMissing || opts.StackPolicyFile != "" || opts.StackPolicyDuringUpdateFile != "" {
+			return upd, errors.New("-resources-to-import can only be used with a single stack, and without -create-if-missing or stack policy files")
+		}
+	}
+	if opts.StackSet {
+		if err := checkStackSetOptions(opts); err != nil {
+			return upd, err
+		}
+	}
+	if opts.ResumeToken != "" && (len(opts.StackNames) != 1 || !opts.Wait || opts.DryRun || opts.ClientRequestToken != "") {
+		return upd, errors.New("-resume can only be used with a single stack, and without -wait=false, -dry-run, or -client-request-token")
+	}
+	if opts.ExecuteChangeSet != "" && (len(opts.StackNames) != 1 || opts.DryRun || opts.ResumeToken != "" || opts.CreateIfMissing) {
+		return upd, errors.New("-execute-change-set can only be used with a single stack, and without -dry-run, -resume, or -create-if-missing")
+	}
+	if example := newToken(opts.TokenPrefix); !validToken(example) {
+		return upd, fmt.Errorf("token prefix %q makes invalid client request tokens: with %d random characters added, tokens must be at most %d characters long,"+
+			" only contain letters, digits, and hyphens, and start with a letter or digit", opts.TokenPrefix, 2*tokenRandomBytes, maxTokenLength)
+	}
+	if opts.ClientRequestToken != "" && !validToken(opts.ClientRequestToken) {
+		return upd, fmt.Errorf("client request token must be 1 to %d characters long, only contain letters, digits, and hyphens,"+
+			" and start with a letter or digit: %q", maxTokenLength, opts.ClientRequestToken)
+	}
+	if opts.ParamsFile != "" {
+		lines, err := readParamsFile(opts.ParamsFile)
+		if err != nil {
+			return upd, err
+		}
+		args = append(lines, args...)
+	}
+	var err error
+	if opts.ExpandEnv {
+		if args, err = expandEnv(args, os.LookupEnv); err != nil {
+			return upd, err
+		}
+	}
+	if upd.params, err = parseKvs(args, opts.AllowEmpty); err != nil {
+		return upd, err
+	}
+	upd.refs = make(map[string]struct{})
+	upd.secrets = make(map[string]bool)
+	for k, v := range upd.params {
+		if isRef(v) {
+			upd.refs[k] = struct{}{}
+		}
+	}
+	for _, kv := range opts.LiteralParams {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" || v == "" && !opts.AllowEmpty {
+			return upd, fmt.Errorf("wrong -param format, want non-empty key and value separated by =: %q", kv)
+		}
+		if old, ok := upd.params[k]; ok && old != v {
+			return upd, fmt.Errorf("conflicting values of %q key in parameters list: %q and %q", k, old, v)
+		}
+		upd.params[k] = v
+	}
+	if upd.tags, err = parseTags(opts.Tags); err != nil {
+		return upd, fmt.Errorf("tags: %w", err)
+	}
+	upd.toDelete = make(map[string]struct{}, len(opts.ToDelete))
+	for _, k := range opts.ToDelete {
+		if _, ok := upd.params[k]; ok {
+			return upd, fmt.Errorf("parameter %q is both set and deleted", k)
+		}
+		upd.toDelete[k] = struct{}{}
+	}
+	for _, k := range opts.TagsToRemove {
+		if _, ok := upd.tags[k]; ok {
+			return upd, fmt.Errorf("tag %q is both set and removed", k)
+		}
+	}
+	upd.empty = len(upd.params) == 0 && len(upd.toDelete) == 0 && len(upd.tags) == 0 && len(opts.TagsToRemove) == 0 &&
+		opts.ResourcesToImportFile == ""
+	if opts.ResumeToken != "" {
+		if !upd.empty || opts.TerminationProtection != nil {
+			return upd, errors.New("-resume only waits for an already started update, it cannot be used with changes to apply")
+		}
+		return upd, nil
+	}
+	if opts.ExecuteChangeSet != "" {
+		if !upd.empty || opts.TerminationProtection != nil || opts.ParamsFromStack != "" || opts.TemplateFile != "" ||
+			opts.TemplateURL != "" || opts.TemplateFromStack != "" {
+			return upd, errors.New("-execute-change-set applies the changes of the change set, it cannot be used with other changes to apply")
+		}
+		return upd, nil
+	}
+	if upd.empty && opts.TerminationProtection == nil && opts.ParamsFromStack == "" {
+		return upd, errors.New("empty parameters list")
+	}
+	// values aren't logged until it's known which of them are NoEcho
+	debugf("loaded parameters: %s", strings.Join(slices.Sorted(maps.Keys(upd.params)), ", "))
+	if opts.StackPolicyFile != "" {
+		if upd.stackPolicy, err = readStackPolicy(opts.StackPolicyFile); err != nil {
+			return upd, err
+		}
+	}
+	if opts.StackPolicyDuringUpdateFile != "" {
+		if upd.stackPolicyDuringUpdate, err = readStackPolicy(opts.StackPolicyDuringUpdateFile); err != nil {
+			return upd, err
+		}
+	}
+	if opts.TemplateFile != "" {
+		if upd.templateBody, err = readTemplate(opts.TemplateFile); err != nil {
+			return upd, err
+		}
+	}
+	if opts.ResourcesToImportFile != "" {
+		if upd.resourcesToImport, err = readResourcesToImport(opts.ResourcesToImportFile); err != nil {
+			return upd, err
+		}
+	}
+	return upd, nil
+}
+
+// stackUpdate describes changes to apply to each stack
+type stackUpdate struct {
+	params   map[string]string   // parameters to set
+	toDelete map[string]struct{} // parameters to remove
+	tags     map[string]string   // tags to set
+	refs     map[string]struct{} // keys of params with values referring to external stores
+	secrets  map[string]bool     // keys of params with secret values resolved from refs
+	empty    bool                // true if there is nothing to change with UpdateStack
+
+	stackPolicy             string
+	stackPolicyDuringUpdate string
+	templateBody            string // if empty, existing or S3-hosted template is used
+
+	resourcesToImport []types.ResourceToImport // if set, the update is done with an import change set
+}
+
+// CloudFormationAPI is the part of CloudFormation API the stacks are updated
+// with, implemented by *cloudformation.Client.
+type CloudFormationAPI interface {
+	cloudformation.DescribeStackEventsAPIClient
+	cloudformation.DescribeStackResourceDriftsAPIClient
+	templateSummarizer
+	GetTemplate(context.Context, *cloudformation.GetTemplateInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error)
+	DescribeStacks(context.Context, *cloudformation.DescribeStacksInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error)
+	UpdateStack(context.Context, *cloudformation.UpdateStackInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error)
+	CreateStack(context.Context, *cloudformation.CreateStackInput, ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error)
+	CancelUpdateStack(context.Context, *cloudformation.CancelUpdateStackInput, ...func(*cloudformation.Options)) (*cloudformation.CancelUpdateStackOutput, error)
+	UpdateTerminationProtection(context.Context, *cloudformation.UpdateTerminationProtectionInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateTerminationProtectionOutput, error)
+	CreateChangeSet(context.Context, *cloudformation.CreateChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.CreateChangeSetOutput, error)
+	DescribeChangeSet(context.Context, *cloudformation.DescribeChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeChangeSetOutput, error)
+	ExecuteChangeSet(context.Context, *cloudformation.ExecuteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error)
+	DeleteChangeSet(context.Context, *cloudformation.DeleteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DeleteChangeSetOutput, error)
+	DetectStackDrift(context.Context, *cloudformation.DetectStackDriftInput, ...func(*cloudformation.Options)) (*cloudformation.DetectStackDriftOutput, error)
+	DescribeStackDriftDetectionStatus(context.Context, *cloudformation.DescribeStackDriftDetectionStatusInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackDriftDetectionStatusOutput, error)
+}
+
+// updateStacks updates all stacks from opts, either one by one or
+// concurrently, at most opts.MaxConcurrent at once, then reports which of
+// them failed.
+func updateStacks(ctx context.Context, svc CloudFormationAPI, opts Options, upd stackUpdate) error {
+	errs := make([]error, len(opts.StackNames))
+	if opts.Parallel || opts.MaxConcurrent > 0 {
+		limit := cmp.Or(opts.MaxConcurrent, len(opts.StackNames))
+		sem := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+		for i, name := range opts.StackNames {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				// updates already started are cancelled by their own
+				// polling, queued ones are not started at all
+				errs[i] = fmt.Errorf("not started: %w", context.Cause(ctx))
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				errs[i] = updateStack(ctx, svc, opts, name, upd)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i, name := range opts.StackNames {
+			infof("updating stack %s", name)
+			errs[i] = updateStack(ctx, svc, opts, name, upd)
+		}
+	}
+	var failed []error
+	for i, name := range opts.StackNames {
+		switch err := errs[i]; {
+		case err == nil:
+			resultf("%s: success", name)
+		case isNoUpdates(err):
+			warnf("%s: nothing to update", name)
+		case errors.Is(err, errStackMissing):
+			warnf("%s: stack does not exist, skipped", name)
+		default:
+			resultf("%s: failed: %v", name, err)
+			failed = append(failed, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d of %d stacks failed to update:\n%w", len(failed), len(opts.StackNames), errors.Join(failed...))
+	}
+	return nil
+}
+
+// updateStack applies upd to a single stack and waits for the update to
+// complete.
+func updateStack(ctx context.Context, svc CloudFormationAPI, opts Options, stackName string, upd stackUpdate) error {
+	stack, err := describeStack(ctx, svc, stackName)
+	if err != nil {
+		switch {
+		case opts.CreateIfMissing && isStackMissing(err):
+			return createStack(ctx, svc, opts, stackName, upd)
+		case opts.IfExists && isStackMissing(err):
+			return errStackMissing
+		}
+		return stackMissingError(err, stackName, opts.Region)
+	}
+	// stack may be referenced by its ARN, but stack events use its name
+	// as the logical resource id
+	stackName = cmp.Or(unptr(stack.StackName), stackName)
+	if opts.ResumeToken != "" {
+		infof("%s: resuming polling for the stack update with %s token", stackName, opts.ResumeToken)
+		err := waitForUpdate(ctx, svc, opts, stackName, opts.ResumeToken, time.Time{})
+		if errors.Is(err, errUpdateFailed) && stack.StackId != nil {
+			return fmt.Errorf("%w, see %s for more details", err, consoleURL(opts.Region, *stack.StackId))
+		}
+		return err
+	}
+	if opts.ExecuteChangeSet != "" {
+		return executeChangeSet(ctx, svc, opts, stack, opts.ExecuteChangeSet)
+	}
+	if opts.TerminationProtection != nil {
+		if err := setTerminationProtection(ctx, svc, opts, stack); err != nil {
+			return err
+		}
+		if upd.empty {
+			return nil
+		}
+	}
+	switch stack.StackStatus {
+	case types.StackStatusCreateComplete,
+		types.StackStatusUpdateComplete,
+		types.StackStatusUpdateRollbackComplete,
+		types.StackStatusUpdateFailed, // after an update with -no-rollback
+		types.StackStatusImportComplete,
+		types.StackStatusImportRollbackComplete:
+	default:
+		return fmt.Errorf("stack %s is in %v state, cannot start a new update", stackName, stack.StackStatus)
+	}
+	if opts.ParamsFromStack != "" {
+		source, err := describeStack(ctx, svc, opts.ParamsFromStack)
+		if err != nil {
+			return fmt.Errorf("reading parameters of %s stack: %w", opts.ParamsFromStack, stackMissingError(err, opts.ParamsFromStack, opts.Region))
+		}
+		upd.params = copyParams(stackName, source, stack, upd.params, upd.toDelete)
+	}
+	if opts.AllowedParams != nil {
+		if err := checkAllowedParams(opts.AllowedParams, upd.params, upd.toDelete); err != nil {
+			return withKind(errUsage, err)
+		}
+	}
+	decls, err := templateParameters(ctx, svc, templateSummaryInput(stackName, upd.templateBody, opts.TemplateURL))
+	if err != nil {
+		warnf("cannot tell which parameters are NoEcho, all values are redacted from the logs: %v", err)
+	}
+	// templates given by URL are only read by CloudFormation
+	if decls != nil && len(upd.params) != 0 && opts.TemplateURL == "" {
+		if err := addAllowedPatterns(ctx, svc, decls, stackName, upd.templateBody); err != nil {
+			warnf("cannot read AllowedPattern constraints of parameters, leaving them to CloudFormation to check: %v", err)
+		}
+	}
+	// with a new template, parameters are matched against its declarations,
+	// as it may have parameters the stack doesn't have and vice versa;
+	// without declarations, they're matched against the current stack
+	var newDecls map[string]templateParam
+	if upd.templateBody != "" || opts.TemplateURL != "" {
+		newDecls = decls
+	}
+	toReplace, toDelete := maps.Clone(upd.params), maps.Clone(upd.toDelete)
+	var params []types.Parameter
+	var previous []string // keys of parameters keeping their values
+	for _, p := range stack.Parameters {
+		k := unptr(p.ParameterKey)
+		if _, ok := toDelete[k]; ok {
+			delete(toDelete, k)
+			continue
+		}
+		if _, ok := newDecls[k]; newDecls != nil && !ok {
+			infof("%s: parameter %q is not declared in the new template, dropping it", stackName, k)
+			continue
+		}
+		if v, ok := toReplace[k]; ok {
+			params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: &v})
+			delete(toReplace, k)
+			continue
+		}
+		params = append(params, types.Parameter{ParameterKey: &k, UsePreviousValue: ptr(true)})
+		previous = append(previous, k)
+	}
+	for _, k := range slices.Sorted(maps.Keys(toReplace)) {
+		if _, ok := newDecls[k]; ok {
+			params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: ptr(toReplace[k])})
+			delete(toReplace, k)
+		}
+	}
+	if len(toReplace) != 0 {
+		what := "stack"
+		var valid []string
+		for _, p := range stack.Parameters {
+			valid = append(valid, unptr(p.ParameterKey))
+		}
+		if newDecls != nil {
+			what = "new template"
+			valid = slices.Collect(maps.Keys(newDecls))
+		}
+		return withKind(errUsage, unknownParamsError(what, slices.Collect(maps.Keys(toReplace)), valid))
+	}
+	if len(toDelete) != 0 {
+		return withKind(errUsage, fmt.Errorf("cannot delete parameters the stack does not have: %s", strings.Join(slices.Sorted(maps.Keys(toDelete)), ", ")))
+	}
+	if opts.RequireAllParams && len(previous) != 0 {
+		slices.Sort(previous)
+		return withKind(errUsage, fmt.Errorf("with -set-all-previous=false, all stack parameters must be set, these are not: %s", strings.Join(previous, ", ")))
+	}
+	if opts.OnlyIfChanged && !hasChanges(opts, stack, upd) {
+		debugf("%s: all parameters already have the requested values", stackName)
+		return errNoUpdates
+	}
+	if opts.CheckDrift || opts.FailOnDrift {
+		if err := checkDrift(ctx, svc, stackName, opts.FailOnDrift); err != nil {
+			return err
+		}
+	}
+
+	noEcho := withMaskedParams(noEchoParameters(decls), stack.Parameters)
+	if noEcho != nil {
+		maps.Copy(noEcho, upd.secrets)
+	}
+	if err := errors.Join(checkParamTypes(decls, upd.params, noEcho), checkAllowedValues(decls, upd.params, noEcho)); err != nil {
+		return withKind(errUsage, err)
+	}
+	if opts.ShowDiff {
+		infoBlock(func(w io.Writer) {
+			printParamsDiff(w, stackName, stack.Parameters, upd.params, upd.toDelete, noEcho)
+		})
+	}
+	debugf("parameters to call UpdateStack with:")
+	for _, p := range params {
+		switch {
+		case unptr(p.UsePreviousValue):
+			debugf("%s (use the previous value)", unptr(p.ParameterKey))
+		default:
+			debugf("%s: %s", unptr(p.ParameterKey), redact(noEcho, unptr(p.ParameterKey), unptr(p.ParameterValue)))
+		}
+	}
+
+	token := cmp.Or(opts.ClientRequestToken, newToken(opts.TokenPrefix))
+	input := updateStackInput(opts, stack, params, upd.tags, token)
+	if upd.stackPolicy != "" {
+		input.StackPolicyBody = &upd.stackPolicy
+	}
+	if upd.stackPolicyDuringUpdate != "" {
+		input.StackPolicyDuringUpdateBody = &upd.stackPolicyDuringUpdate
+	}
+	if upd.templateBody != "" {
+		input.TemplateBody = &upd.templateBody
+		input.UsePreviousTemplate = nil
+	}
+	if opts.TemplateURL != "" {
+		input.TemplateURL = &opts.TemplateURL
+		input.UsePreviousTemplate = nil
+	}
+	if opts.DryRun {
+		return capabilitiesError(dryRun(ctx, svc, input, upd.resourcesToImport), input.Capabilities)
+	}
+	if opts.Confirm && !opts.Yes {
+		if !opts.ShowDiff {
+			printParamsDiff(os.Stderr, stackName, stack.Parameters, upd.params, upd.toDelete, noEcho)
+		}
+		ok, err := confirm(os.Stdin, os.Stderr, "Apply these changes?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("update of %s stack was not confirmed", stackName)
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		if err = startUpdate(ctx, svc, opts, input, upd.resourcesToImport); err != nil {
+			return capabilitiesError(err, input.Capabilities)
+		}
+		if !opts.Wait {
+			infof("stack update started, not waiting for it to complete; client request token:")
+			fmt.Println(token)
+			return nil
+		}
+		err = waitForUpdate(ctx, svc, opts, stackName, token, started)
+		if attempt >= opts.MaxAttempts || ctx.Err() != nil || !errors.Is(err, errUpdateFailed) || !isRetryableFailure(err) {
+			break
+		}
+		warnf("%s: update failed with an error that may be transient, retrying (attempt %d of %d): %v", stackName, attempt+1, opts.MaxAttempts, err)
+		token = newToken(opts.TokenPrefix)
+		input.ClientRequestToken = &token
+	}
+	if name := os.Getenv("GITHUB_STEP_SUMMARY"); underGithub && name != "" {
+		if final, err := describeStack(context.WithoutCancel(ctx), svc, stackName); err != nil {
+			warnf("cannot write step summary: %v", err)
+		} else if err := appendStepSummary(name, final, stack.Parameters, upd.params, upd.toDelete, noEcho); err != nil {
+			warnf("writing step summary: %v", err)
+		}
+	}
+	if errors.Is(err, errUpdateFailed) && stack.StackId != nil {
+		return fmt.Errorf("%w, see %s for more details", err, consoleURL(opts.Region, *stack.StackId))
+	}
+	return err
+}
+
+// startUpdate starts the update with input, importing resources if any. If
+// the update is rejected because of notification topics the stack already
+// had, e.g. ones deleted since, it's retried once without them when
+// opts.DropBadNotificationARNs is set.
+func startUpdate(ctx context.Context, svc CloudFormationAPI, opts Options, input *cloudformation.UpdateStackInput, resources []types.ResourceToImport) error {
+	call := func() error {
+		if len(resources) != 0 {
+			return importResources(ctx, svc, input, resources)
+		}
+		_, err := svc.UpdateStack(ctx, input)
+		return err
+	}
+	err := call()
+	bad := badNotificationARNs(err, input.NotificationARNs)
+	if len(bad) == 0 || opts.NotificationARNs != nil {
+		return err
+	}
+	if !opts.DropBadNotificationARNs {
+		return fmt.Errorf("%w; to update the stack without notification topics it cannot use,"+
+			" run with -drop-bad-notification-arns", err)
+	}
+	warnf("%s: update rejected because of notification topics, retrying without them: %s",
+		unptr(input.StackName), strings.Join(bad, ", "))
+	// keep the slice non-nil: an empty list removes the topics from the stack
+	input.NotificationARNs = slices.DeleteFunc(slices.Clone(input.NotificationARNs),
+		func(arn string) bool { return slices.Contains(bad, arn) })
+	return call()
+}
+
+// badNotificationARNs returns ARNs from arns that err, if it's the API error
+// for invalid notification topics, is about.
+func badNotificationARNs(err error, arns []string) []string {
+	var ae smithy.APIError
+	if len(arns) == 0 || !errors.As(err, &ae) || ae.ErrorCode() != "ValidationError" {
+		return nil
+	}
+	msg := ae.ErrorMessage()
+	if lower := strings.ToLower(msg); !strings.Contains(lower, "notification") && !strings.Contains(lower, "topic") {
+		return nil
+	}
+	var bad []string
+	for _, arn := range arns {
+		if strings.Contains(msg, arn) {
+			bad = append(bad, arn)
+		}
+	}
+	return bad
+}
+
+// checkAllowedParams verifies that only parameters from allowed are to be set
+// or deleted.
+func checkAllowedParams(allowed []string, params map[string]string, toDelete map[string]struct{}) error {
+	var denied []string
+	for k := range params {
+		if !slices.Contains(allowed, k) {
+			denied = append(denied, k)
+		}
+	}
+	for k := range toDelete {
+		if !slices.Contains(allowed, k) {
+			denied = append(denied, k)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	slices.Sort(denied)
+	return fmt.Errorf("only these parameters are allowed to change: %s; not allowed: %s",
+		strings.Join(allowed, ", "), strings.Join(denied, ", "))
+}
+
+// unknownParamsError returns an error listing the unknown parameter names,
+// with suggestions for likely typos, and the valid ones.
+func unknownParamsError(what string, unknown, valid []string) error {
+	valid = slices.Sorted(slices.Values(valid))
+	var names []string
+	for _, k := range slices.Sorted(slices.Values(unknown)) {
+		if s := closestName(k, valid); s != "" {
+			k = fmt.Sprintf("%s (did you mean %q?)", k, s)
+		}
+		names = append(names, k)
+	}
+	return fmt.Errorf("%s has no parameters with these names: %s; valid names are: %s",
+		what, strings.Join(names, ", "), strings.Join(valid, ", "))
+}
+
+// closestName returns the name from names that name is most likely a typo
+// of, or an empty string if none of them is close enough.
+func closestName(name string, names []string) string {
+	// allow a couple of typos, but not in names so short that it would
+	// make them entirely different
+	limit := min(2, len(name)/3)
+	var best string
+	for _, s := range names {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(s)); d <= limit {
+			best, limit = s, d-1
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b, counted in
+// bytes.
+func editDistance(a, b string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// copyParams returns params with added values of source stack parameters that
+// the target stack also has, unless they're already set or to be deleted.
+// NoEcho parameters are skipped, since their values can't be read.
+func copyParams(stackName string, source, target *types.Stack, params map[string]string, toDelete map[string]struct{}) map[string]string {
+	out := make(map[string]string, len(params)+len(source.Parameters))
+	maps.Copy(out, params)
+	known := make(map[string]struct{}, len(target.Parameters))
+	for _, p := range target.Parameters {
+		known[unptr(p.ParameterKey)] = struct{}{}
+	}
+	for _, p := range source.Parameters {
+		k, v := unptr(p.ParameterKey), unptr(p.ParameterValue)
+		if _, ok := known[k]; !ok {
+			continue
+		}
+		if _, ok := out[k]; ok {
+			continue
+		}
+		if _, ok := toDelete[k]; ok {
+			continue
+		}
+		if v == noEchoMask {
+			warnf("%s: value of %q parameter of %s stack can't be read, it's NoEcho; not copying it", stackName, k, unptr(source.StackName))
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// hasChanges reports whether updating the stack with upd and opts may change
+// anything. It only returns false if all parameters to set already have the
+// requested values, and nothing else is set to change.
+func hasChanges(opts Options, stack *types.Stack, upd stackUpdate) bool {
+	if len(upd.toDelete) != 0 || upd.templateBody != "" || opts.TemplateURL != "" ||
+		upd.stackPolicy != "" || upd.stackPolicyDuringUpdate != "" ||
+		opts.Capabilities != nil || opts.NotificationARNs != nil ||
+		opts.RollbackMinutes != nil || len(opts.RollbackTriggers) != 0 {
+		return true
+	}
+	current := make(map[string]string, len(stack.Parameters))
+	for _, p := range stack.Parameters {
+		current[unptr(p.ParameterKey)] = unptr(p.ParameterValue)
+	}
+	for k, v := range upd.params {
+		// values of NoEcho parameters are masked, so can't be compared
+		if old, ok := current[k]; !ok || old != v || old == noEchoMask {
+			return true
+		}
+	}
+	if len(upd.tags) != 0 || len(opts.TagsToRemove) != 0 {
+		tagValue := func(t types.Tag) string { return unptr(t.Key) + "=" + unptr(t.Value) }
+		var was, want []string
+		for _, t := range stack.Tags {
+			was = append(was, tagValue(t))
+		}
+		for _, t := range mergeTags(stack.Tags, upd.tags, opts.TagsToRemove) {
+			want = append(want, tagValue(t))
+		}
+		slices.Sort(was)
+		slices.Sort(want)
+		return !slices.Equal(was, want)
+	}
+	return false
+}
+
+// confirm asks a yes/no question on out and reads the answer from in,
+// treating anything other than "y" or "yes" as no.
+func confirm(in io.Reader, out io.Writer, question string) (bool, error) {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return false, fmt.Errorf("reading confirmation: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// setTerminationProtection changes termination protection of the stack to
+// the one set in opts, if it differs.
+func setTerminationProtection(ctx context.Context, svc CloudFormationAPI, opts Options, stack *types.Stack) error {
+	stackName := unptr(stack.StackName)
+	was, want := unptr(stack.EnableTerminationProtection), *opts.TerminationProtection
+	if was == want {
+		infof("%s: termination protection is already %s", stackName, onOff(want))
+		return nil
+	}
+	if opts.DryRun {
+		infof("%s: termination protection would be turned %s", stackName, onOff(want))
+		return nil
+	}
+	_, err := svc.UpdateTerminationProtection(ctx, &cloudformation.UpdateTerminationProtectionInput{
+		StackName:                   stack.StackId,
+		EnableTerminationProtection: &want,
+	})
+	if err != nil {
+		return fmt.Errorf("updating termination protection: %w", err)
+	}
+	infof("%s: termination protection turned %s, was %s", stackName, onOff(want), onOff(was))
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// createStack creates a new stack from the template set in opts and upd,
+// with upd parameters and tags, then waits for the creation to complete.
+func createStack(ctx context.Context, svc CloudFormationAPI, opts Options, stackName string, upd stackUpdate) error {
+	if len(upd.toDelete) != 0 {
+		return withKind(errUsage, fmt.Errorf("stack %s does not exist, cannot delete its parameters", stackName))
+	}
+	if opts.DryRun {
+		infof("stack %s does not exist and would be created", stackName)
+		return nil
+	}
+	params := make([]types.Parameter, 0, len(upd.params))
+	for _, k := range slices.Sorted(maps.Keys(upd.params)) {
+		params = append(params, types.Parameter{ParameterKey: &k, ParameterValue: ptr(upd.params[k])})
+	}
+	token := cmp.Or(opts.ClientRequestToken, newToken(opts.TokenPrefix))
+	// new stack has nothing to inherit, so its settings are only the ones
+	// from opts
+	input := updateStackInput(opts, &types.Stack{StackName: &stackName}, params, upd.tags, token)
+	createInput := &cloudformation.CreateStackInput{
+		StackName:             input.StackName,
+		ClientRequestToken:    input.ClientRequestToken,
+		Parameters:            input.Parameters,
+		Capabilities:          input.Capabilities,
+		NotificationARNs:      input.NotificationARNs,
+		Tags:                  input.Tags,
+		RollbackConfiguration: input.RollbackConfiguration,
+		DisableRollback:       input.DisableRollback,
+		// protection would otherwise only be set when updating
+		EnableTerminationProtection: opts.TerminationProtection,
+	}
+	if upd.stackPolicy != "" {
+		createInput.StackPolicyBody = &upd.stackPolicy
+	}
+	if upd.templateBody != "" {
+		createInput.TemplateBody = &upd.templateBody
+	}
+	if opts.TemplateURL != "" {
+		createInput.TemplateURL = &opts.TemplateURL
+	}
+	infof("stack %s does not exist, creating it", stackName)
+	started := time.Now()
+	out, err := svc.CreateStack(ctx, createInput)
+	if err != nil {
+		return capabilitiesError(err, createInput.Capabilities)
+	}
+	if !opts.Wait {
+		infof("stack creation started, not waiting for it to complete; client request token:")
+		fmt.Println(token)
+		return nil
+	}
+	err = waitForUpdate(ctx, svc, opts, stackName, token, started)
+	if errors.Is(err, errUpdateFailed) && out.StackId != nil {
+		return fmt.Errorf("%w, see %s for more details", err, consoleURL(opts.Region, *out.StackId))
+	}
+	return err
+}
+
+// consoleURL returns URL of the stack events page in AWS CloudFormation
+// Console.
+func consoleURL(region, stackID string) string {
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/cloudformation/home?region=%s#/stacks/events?stackId=%s",
+		region, region, url.QueryEscape(stackID))
+}
+
+func describeStack(ctx context.Context, svc CloudFormationAPI, stackName string) (*types.Stack, error) {
+	desc, err := svc.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: &stackName})
+	if err != nil {
+		return nil, err
+	}
+	if l := len(desc.Stacks); l != 1 {
+		return nil, fmt.Errorf("DescribeStacks returned %d stacks, expected 1", l)
+	}
+	return &desc.Stacks[0], nil
+}
+
+// eventsCutoff returns the time stack events older than which cannot belong
+// to the update: opts.EventsSince ago, or when the last stack operation began
+// if opts.SinceLastOperation is set, but no earlier than started, if it's not
+// zero.
+func eventsCutoff(ctx context.Context, svc CloudFormationAPI, opts Options, stackName string, started time.Time) time.Time {
+	cutoff := time.Now().Add(-opts.EventsSince)
+	if opts.SinceLastOperation {
+		if stack, err := describeStack(ctx, svc, stackName); err != nil {
+			warnf("cannot tell when the last operation on %s stack began, scanning events of the last %v: %v", stackName, opts.EventsSince, err)
+		} else if t := cmp.Or(unptr(stack.LastUpdatedTime), unptr(stack.CreationTime)); !t.IsZero() {
+			// LastUpdatedTime is set as the update begins, and also
+			// covers its rollback
+			cutoff = t.Add(-clockSkew)
+			debugf("scanning %s stack events since %v", stackName, cutoff.Format(time.RFC3339))
+		}
+	}
+	if !started.IsZero() {
+		// events of our update are recorded while UpdateStack call is
+		// still in flight, and server clock may differ from ours
+		if t := started.Add(-clockSkew); t.After(cutoff) {
+			cutoff = t
+		}
+	}
+	return cutoff
+}
+
+// waitForUpdate polls stack events until the update identified by token
+// reaches a terminal state. It gives up once opts.Timeout passes, unless
+// it is zero. If started is not zero, it's the time the update was started
+// at, and older events are not scanned.
+func waitForUpdate(ctx context.Context, svc CloudFormationAPI, opts Options, stackName, token string, started time.Time) error {
+	parent := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout,
+			withKind(errTimeout, fmt.Errorf("timed out after %v waiting for stack update", opts.Timeout)))
+		defer cancel()
+	}
+	infof("polling for %s stack updates until it's ready, this may take a while", stackName)
+	begin := cmp.Or(started, time.Now())
+	timings := make(resourceTimings)
+	defer func() {
+		infof("%s: stack update took %v", stackName, time.Since(begin).Round(time.Second))
+		if !quiet {
+			infoBlock(timings.print)
+		}
+	}()
+	oldEventsCutoff := eventsCutoff(ctx, svc, opts, stackName, started)
+	if opts.InitialDelay > 0 {
+		debugf("waiting %v before polling for stack events", opts.InitialDelay)
+		t := time.NewTimer(opts.InitialDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done(): // handled by the polling loop
+		}
+		t.Stop()
+	}
+	ticker := time.NewTicker(opts.PollInterval)
+	var likelyRootCause error
+	defer ticker.Stop()
+	seen := make(map[string]struct{})
+	prog := make(progress)
+	lastEvent := make(map[string]time.Time) // by logical id, for stall detection
+	stallWarned := make(map[string]bool)
+	var failures []types.StackEvent
+	nested := make(map[string]string) // nested stack ids by their logical ids
+	tokens := []string{token}
+	var cancelRequested bool
+	var polls int
+	ignored := opts.IgnoreFailureReasons
+	if ignored == nil {
+		ignored = defaultIgnoredReasons
+	}
+	for first := true; ; first = false {
+		// the first poll is done right away, as updates that change no
+		// resources may complete before the first tick; events of an
+		// earlier operation are told apart by their tokens, not by time
+		if !first {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+		var events []types.StackEvent
+		var err error
+		if ctx.Err() == nil {
+			events, err = stackEvents(ctx, svc, stackName, tokens, oldEventsCutoff)
+		}
+		if ctx.Err() != nil {
+			if parent.Err() == nil {
+				return fmt.Errorf("%w; %s", context.Cause(ctx), inProgressHint(stackName, token))
+			}
+			if errors.Is(parent.Err(), context.DeadlineExceeded) {
+				// no time is left to wait for a rollback, so the update is
+				// left running rather than cancelled
+				return withKind(errInterrupted, fmt.Errorf("deadline exceeded while waiting for stack update: %w; %s",
+					context.Cause(parent), inProgressHint(stackName, token)))
+			}
+			if !opts.CancelOnInterrupt {
+				return withKind(errInterrupted, fmt.Errorf("stopped waiting for stack update: %w; %s",
+					context.Cause(parent), inProgressHint(stackName, token)))
+			}
+			// only updates can be cancelled, a stack being created
+			// can only be deleted once the creation ends
+			if stack, err := describeStack(context.WithoutCancel(parent), svc, stackName); err == nil &&
+				stack.StackStatus == types.StackStatusCreateInProgress {
+				return withKind(errInterrupted, fmt.Errorf("interrupted while %s stack is being created, which cannot be cancelled;"+
+					" to wait for it run with -stack=%s -resume=%s, or delete the stack once the creation ends", stackName, stackName, token))
+			}
+			// the update is cancelled and followed until rollback
+			// completes, without a timeout: another interrupt is
+			// expected to terminate the program
+			warnf("interrupted, cancelling stack update; interrupt again to exit immediately")
+			cancelRequested = true
+			ctx = context.WithoutCancel(parent)
+			cancelToken := newToken(opts.TokenPrefix)
+			_, err := svc.CancelUpdateStack(ctx, &cloudformation.CancelUpdateStackInput{
+				StackName:          &stackName,
+				ClientRequestToken: &cancelToken,
+			})
+			if err != nil {
+				return withKind(errInterrupted, fmt.Errorf("cancelling stack update: %w; %s", err, inProgressHint(stackName, token)))
+			}
+			infof("stack update cancellation requested, waiting for rollback to complete")
+			tokens = append(tokens, cancelToken)
+			continue
+		}
+		if err != nil {
+			if isThrottling(err) {
+				warnf("stack events polling was throttled, will retry: %v", err)
+				continue
+			}
+			return err
+		}
+		fresh := unseen(seen, events)
+		polls++
+		logEvents(fmt.Sprintf("%s stack events, poll #%d", stackName, polls), fresh)
+		recordEvents(stackName, fresh)
+		if opts.FollowNested {
+			// nested stack events are handled first, so that their failures
+			// are known by the time the parent stack reaches its final state
+			addNestedStacks(nested, stackName, fresh)
+			for _, id := range slices.Sorted(maps.Keys(nested)) {
+				// nested stack operations have their own tokens, but are
+				// limited to the time of the parent one
+				events, err := stackEvents(ctx, svc, nested[id], nil, oldEventsCutoff)
+				if err != nil {
+					warnf("%s: polling events of nested stack %s: %v", stackName, id, err)
+					continue
+				}
+				events = unseen(seen, events)
+				logEvents(fmt.Sprintf("%s nested stack events, poll #%d", id, polls), events)
+				recordEvents(id, events)
+				addNestedStacks(nested, id, events)
+				for _, evt := range events {
+					if likelyRootCause == nil && isRootCause(evt, ignored) {
+						likelyRootCause = fmt.Errorf("%s/%s %v: %s", id, unptr(evt.LogicalResourceId), evt.ResourceStatus, unptr(evt.ResourceStatusReason))
+						debugf("likely root cause: %v", likelyRootCause)
+					}
+					if isFailure(evt.ResourceStatus) && unptr(evt.ResourceType) != "AWS::CloudFormation::Stack" {
+						failures = append(failures, evt)
+					}
+				}
+			}
+		}
+		for _, evt := range fresh {
+			// events are processed oldest first, so this keeps the
+			// original failure, not the ones caused by the rollback
+			if likelyRootCause == nil && isRootCause(evt, ignored) {
+				likelyRootCause = fmt.Errorf("%s %v: %s", unptr(evt.LogicalResourceId), evt.ResourceStatus, unptr(evt.ResourceStatusReason))
+				debugf("likely root cause: %v", likelyRootCause)
+			}
+			if unptr(evt.LogicalResourceId) != stackName {
+				prog[unptr(evt.LogicalResourceId)] = evt.ResourceStatus
+				timings.add(evt)
+				lastEvent[unptr(evt.LogicalResourceId)] = cmp.Or(unptr(evt.Timestamp), time.Now())
+				delete(stallWarned, unptr(evt.LogicalResourceId))
+				if isFailure(evt.ResourceStatus) {
+					failures = append(failures, evt)
+				}
+			}
+			if unptr(evt.LogicalResourceId) == stackName && unptr(evt.ResourceType) == "AWS::CloudFormation::Stack" {
+				if slices.Contains(opts.WaitForStatus, evt.ResourceStatus) {
+					return nil
+				}
+				switch evt.ResourceStatus {
+				case types.ResourceStatusUpdateRollbackComplete,
+					types.ResourceStatusUpdateRollbackFailed,
+					types.ResourceStatusRollbackComplete, // after a failed stack creation
+					types.ResourceStatusRollbackFailed,
+					types.ResourceStatusImportRollbackComplete,
+					types.ResourceStatusImportRollbackFailed:
+					infoBlock(func(w io.Writer) { printFailures(w, failures) })
+					if cancelRequested {
+						return withKind(errUpdateFailed, fmt.Errorf("stack update was cancelled, stack is in %v state", evt.ResourceStatus))
+					}
+					return withKind(errUpdateFailed, cmp.Or(likelyRootCause, fmt.Errorf("stack is in %v state", evt.ResourceStatus)))
+				case types.ResourceStatusUpdateFailed, types.ResourceStatusCreateFailed:
+					// only final when rollback is disabled, otherwise
+					// the stack reports (UPDATE_)ROLLBACK_IN_PROGRESS
+					if opts.NoRollback {
+						infoBlock(func(w io.Writer) { printFailures(w, failures) })
+						return withKind(errUpdateFailed, cmp.Or(likelyRootCause, fmt.Errorf("stack is in %v state", evt.ResourceStatus)))
+					}
+				case types.ResourceStatusUpdateComplete, types.ResourceStatusCreateComplete, types.ResourceStatusImportComplete:
+					if len(opts.WaitForStatus) != 0 {
+						return withKind(errUpdateFailed, fmt.Errorf("stack reached %v state, want one of: %v", evt.ResourceStatus, opts.WaitForStatus))
+					}
+					return nil
+				}
+			}
+		}
+		if len(prog) != 0 {
+			infof("%s: %s", stackName, prog.format(useColor))
+		}
+		if opts.StallTimeout > 0 {
+			for _, id := range stalled(prog, lastEvent, time.Now(), opts.StallTimeout) {
+				if !stallWarned[id] {
+					stallWarned[id] = true
+					warnf("%s: resource %s has been in %v state for more than %v", stackName, id, prog[id], opts.StallTimeout)
+				}
+			}
+		}
+	}
+}
+
+// inProgressHint tells how to keep waiting for the stack update with the
+// given token, once the tool stops following it.
+func inProgressHint(stackName, token string) string {
+	return fmt.Sprintf("the update of %s stack is still in progress in AWS, to wait for it run with -stack=%s -resume=%s", stackName, stackName, token)
+}
+
+// unseen returns events with ids not in seen, and adds their ids to it.
+func unseen(seen map[string]struct{}, events []types.StackEvent) []types.StackEvent {
+	out := events[:0]
+	for _, evt := range events {
+		if id := unptr(evt.EventId); id != "" {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+		}
+		out = append(out, evt)
+	}
+	return out
+}
+
+// addNestedStacks records ids of nested stacks found in events of the named
+// stack to nested, keyed by their logical ids.
+func addNestedStacks(nested map[string]string, stackName string, events []types.StackEvent) {
+	for _, evt := range events {
+		id, physID := unptr(evt.LogicalResourceId), unptr(evt.PhysicalResourceId)
+		if unptr(evt.ResourceType) == "AWS::CloudFormation::Stack" && id != stackName && strings.HasPrefix(physID, "arn:") {
+			nested[id] = physID
+		}
+	}
+}
+
+func isFailure(status types.ResourceStatus) bool {
+	switch status {
+	case types.ResourceStatusUpdateFailed,
+		types.ResourceStatusCreateFailed,
+		types.ResourceStatusDeleteFailed:
+		return true
+	}
+	return false
+}
+
+// isRootCause reports whether evt is a resource failure that may have caused
+// the stack update or creation to fail, rather than a consequence of another
+// failure. Failures with reasons matching any of ignored are consequences.
+func isRootCause(evt types.StackEvent, ignored []*regexp.Regexp) bool {
+	switch evt.ResourceStatus {
+	case types.ResourceStatusUpdateFailed, types.ResourceStatusCreateFailed:
+	default:
+		return false
+	}
+	reason := unptr(evt.ResourceStatusReason)
+	for _, re := range ignored {
+		if re.MatchString(reason) {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultIgnoredReasons match failure reasons of resources CloudFormation
+// cancels once another resource fails.
+var defaultIgnoredReasons = []*regexp.Regexp{
+	regexp.MustCompile(`^Resource (update|creation) cancelled\.?$`),
+}
+
+// resourceTimings tracks when operations on resources started and ended,
+// keyed by logical ids.
+type resourceTimings map[string]*struct{ start, end time.Time }
+
+// add records the time of evt as the start or the end of the operation on
+// its resource.
+func (rt resourceTimings) add(evt types.StackEvent) {
+	id, ts := unptr(evt.LogicalResourceId), unptr(evt.Timestamp)
+	t := rt[id]
+	if t == nil {
+		t = new(struct{ start, end time.Time })
+		rt[id] = t
+	}
+	switch {
+	case strings.HasSuffix(string(evt.ResourceStatus), "_IN_PROGRESS"):
+		if t.start.IsZero() {
+			t.start = ts
+		}
+	default:
+		t.end = ts
+	}
+}
+
+// print writes a table of resources and how long operations on them took,
+// longest first.
+func (rt resourceTimings) print(w io.Writer) {
+	type timing struct {
+		id string
+		d  time.Duration
+	}
+	var out []timing
+	for id, t := range rt {
+		if !t.start.IsZero() && !t.end.IsZero() {
+			out = append(out, timing{id, t.end.Sub(t.start)})
+		}
+	}
+	if len(out) == 0 {
+		return
+	}
+	slices.SortFunc(out, func(a, b timing) int {
+		return cmp.Or(cmp.Compare(b.d, a.d), cmp.Compare(a.id, b.id))
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOGICAL ID\tDURATION")
+	for _, t := range out {
+		fmt.Fprintf(tw, "%s\t%v\n", t.id, t.d.Round(time.Second))
+	}
+	tw.Flush()
+}
+
+// printFailures writes a table of failed resource events to w.
+func printFailures(w io.Writer, events []types.StackEvent) {
+	if len(events) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOGICAL ID\tRESOURCE TYPE\tSTATUS\tREASON")
+	for _, evt := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", unptr(evt.LogicalResourceId), unptr(evt.ResourceType), evt.ResourceStatus, unptr(evt.ResourceStatusReason))
+	}
+	tw.Flush()
+}
+
+// progress tracks the latest status of each stack resource, keyed by
+// logical id.
+type progress map[string]types.ResourceStatus
+
+// String returns a summary like "5/12 resources complete, 2 in progress".
+func (p progress) String() string { return p.format(false) }
+
+// format returns the summary returned by String, with the counts colored if
+// color is set.
+func (p progress) format(color bool) string {
+	var complete, inProgress, failed int
+	for _, status := range p {
+		switch s := string(status); {
+		case strings.HasSuffix(s, "_IN_PROGRESS"):
+			inProgress++
+		case strings.HasSuffix(s, "_FAILED"):
+			failed++
+		default:
+			complete++
+		}
+	}
+	out := fmt.Sprintf("%s/%d resources complete, %s in progress",
+		paint(color, colorGreen, strconv.Itoa(complete)), len(p), paint(color, colorYellow, strconv.Itoa(inProgress)))
+	if failed != 0 {
+		out += ", " + paint(color, colorRed, fmt.Sprintf("%d failed", failed))
+	}
+	return out
+}
+
+// stalled returns sorted logical ids of resources in progress whose
+// last event is older than timeout.
+func stalled(p progress, lastEvent map[string]time.Time, now time.Time, timeout time.Duration) []string {
+	var out []string
+	for id, status := range p {
+		if strings.HasSuffix(string(status), "_IN_PROGRESS") && now.Sub(lastEvent[id]) > timeout {
+			out = append(out, id)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// stackEvents returns stack events of the operations identified by tokens in
+// chronological order, or all events if tokens is nil. It stops scanning at
+// the first event older than cutoff.
+func stackEvents(ctx context.Context, svc CloudFormationAPI, stackName string, tokens []string, cutoff time.Time) ([]types.StackEvent, error) {
+	var out []types.StackEvent
+	p := cloudformation.NewDescribeStackEventsPaginator(svc, &cloudformation.DescribeStackEventsInput{StackName: &stackName})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, evt := range page.StackEvents {
+			if evt.Timestamp != nil && evt.Timestamp.Before(cutoff) {
+				slices.Reverse(out)
+				return out, nil
+			}
+			if tokens == nil || slices.Contains(tokens, unptr(evt.ClientRequestToken)) {
+				out = append(out, evt)
+			}
+		}
+	}
+	slices.Reverse(out)
+	return out, nil
+}
+
+// parseCapabilities parses a comma-separated list of capabilities, rejecting
+// unknown values. It returns a non-nil slice even if s is empty.
+func parseCapabilities(s string) ([]types.Capability, error) {
+	known := types.Capability("").Values()
+	out := []types.Capability{}
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if !slices.Contains(known, types.Capability(c)) {
+			return nil, fmt.Errorf("unknown capability %q, valid values are: %v", c, known)
+		}
+		if !slices.Contains(out, types.Capability(c)) {
+			out = append(out, types.Capability(c))
+		}
+	}
+	return out, nil
+}
+
+// noEchoMask is how DescribeStacks reports values of NoEcho parameters
+const noEchoMask = "****"
+
+// templateSummaryInput returns GetTemplateSummary input for the template the
+// stack is going to be updated with: either the new one, if set, or the
+// current one.
+func templateSummaryInput(stackName, templateBody, templateURL string) *cloudformation.GetTemplateSummaryInput {
+	switch {
+	case templateBody != "":
+		return &cloudformation.GetTemplateSummaryInput{TemplateBody: &templateBody}
+	case templateURL != "":
+		return &cloudformation.GetTemplateSummaryInput{TemplateURL: &templateURL}
+	}
+	return &cloudformation.GetTemplateSummaryInput{StackName: &stackName}
+}
+
+// templateParam describes a parameter declared in a stack template.
+type templateParam struct {
+	typ            string // e.g. String, Number, List<Number>
+	noEcho         bool
+	defaultValue   string
+	allowedValues  []string
+	allowedPattern string // only set by addAllowedPatterns
+}
+
+// templateSummarizer is the part of CloudFormation API used by
+// templateParameters
+type templateSummarizer interface {
+	GetTemplateSummary(context.Context, *cloudformation.GetTemplateSummaryInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateSummaryOutput, error)
+}
+
+// templateParameters returns parameters declared in the template, keyed by
+// their names. It makes a single GetTemplateSummary call, so that all the
+// checks relying on parameter declarations share it.
+func templateParameters(ctx context.Context, svc templateSummarizer, input *cloudformation.GetTemplateSummaryInput) (map[string]templateParam, error) {
+	summary, err := svc.GetTemplateSummary(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]templateParam, len(summary.Parameters))
+	for _, d := range summary.Parameters {
+		p := templateParam{
+			typ:          unptr(d.ParameterType),
+			noEcho:       unptr(d.NoEcho),
+			defaultValue: unptr(d.DefaultValue),
+		}
+		if d.ParameterConstraints != nil {
+			p.allowedValues = d.ParameterConstraints.AllowedValues
+		}
+		out[unptr(d.ParameterKey)] = p
+	}
+	return out, nil
+}
+
+// addAllowedPatterns sets AllowedPattern constraints of decls, which
+// GetTemplateSummary does not report, from the Parameters section of the
+// template body. If body is empty, the current template of the stack is read.
+func addAllowedPatterns(ctx context.Context, svc CloudFormationAPI, decls map[string]templateParam, stackName, body string) error {
+	if body == "" {
+		out, err := svc.GetTemplate(ctx, &cloudformation.GetTemplateInput{
+			StackName:     &stackName,
+			TemplateStage: types.TemplateStageOriginal,
+		})
+		if err != nil {
+			return err
+		}
+		body = unptr(out.TemplateBody)
+	}
+	// JSON templates are valid YAML too
+	var tmpl struct {
+		Parameters map[string]struct {
+			AllowedPattern string `yaml:"AllowedPattern"`
+		} `yaml:"Parameters"`
+	}
+	if err := yaml.Unmarshal([]byte(body), &tmpl); err != nil {
+		return fmt.Errorf("parsing template: %w", err)
+	}
+	for k, p := range tmpl.Parameters {
+		if d, ok := decls[k]; ok && p.AllowedPattern != "" {
+			d.allowedPattern = p.AllowedPattern
+			decls[k] = d
+		}
+	}
+	return nil
+}
+
+// noEchoParameters returns names of NoEcho parameters. For nil decls, it
+// returns nil map, which redact treats as if all parameters are NoEcho.
+func noEchoParameters(decls map[string]templateParam) map[string]bool {
+	if decls == nil {
+		return nil
+	}
+	out := make(map[string]bool)
+	for k, p := range decls {
+		if p.noEcho {
+			out[k] = true
+		}
+	}
+	return out
+}
+
+// checkAllowedValues verifies that params only have values allowed by
+// the AllowedValues and AllowedPattern constraints of the template.
+func checkAllowedValues(decls map[string]templateParam, params map[string]string, noEcho map[string]bool) error {
+	var errs []error
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		v, allowed := params[k], decls[k].allowedValues
+		hidden := noEcho == nil || noEcho[k]
+		if len(allowed) != 0 && !isAllowed(decls[k], v) {
+			if hidden {
+				errs = append(errs, fmt.Errorf("value of %q parameter is not one of its allowed values", k))
+			} else {
+				errs = append(errs, fmt.Errorf("value %q of %q parameter is not one of its allowed values: %s", v, k, strings.Join(allowed, ", ")))
+			}
+		}
+		pattern := decls[k].allowedPattern
+		if pattern == "" {
+			continue
+		}
+		// patterns are Java regular expressions, some of which RE2 does
+		// not support; those are left to CloudFormation to check
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			debugf("cannot check AllowedPattern of %q parameter: %v", k, err)
+			continue
+		}
+		if matchesPattern(decls[k], re, v) {
+			continue
+		}
+		if hidden {
+			errs = append(errs, fmt.Errorf("value of %q parameter does not match its allowed pattern", k))
+			continue
+		}
+		errs = append(errs, fmt.Errorf("value %q of %q parameter does not match its allowed pattern %s", v, k, pattern))
+	}
+	return errors.Join(errs...)
+}
+
+// matchesPattern reports whether v matches re, the AllowedPattern of p. For
+// list parameters, each element must match.
+func matchesPattern(p templateParam, re *regexp.Regexp, v string) bool {
+	if !isListType(p.typ) {
+		return re.MatchString(v)
+	}
+	for _, e := range strings.Split(v, ",") {
+		if !re.MatchString(strings.TrimSpace(e)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAllowed reports whether v is one of allowed values of p. For list
+// parameters, each element must be allowed.
+func isAllowed(p templateParam, v string) bool {
+	if !isListType(p.typ) {
+		return slices.Contains(p.allowedValues, v)
+	}
+	for _, e := range strings.Split(v, ",") {
+		if !slices.Contains(p.allowedValues, strings.TrimSpace(e)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isListType(typ string) bool {
+	return typ == "CommaDelimitedList" || strings.HasPrefix(typ, "List<")
+}
+
+// checkParamTypes verifies that values of Number and List<Number> params are
+// numbers or comma-separated lists of numbers.
+func checkParamTypes(decls map[string]templateParam, params map[string]string, noEcho map[string]bool) error {
+	var errs []error
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		v, typ := params[k], decls[k].typ
+		var elems []string
+		switch typ {
+		case "Number":
+			elems = []string{v}
+		case "List<Number>":
+			elems = strings.Split(v, ",")
+		default:
+			continue
+		}
+		for _, e := range elems {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(e), 64); err == nil {
+				continue
+			}
+			if noEcho == nil || noEcho[k] {
+				errs = append(errs, fmt.Errorf("value of %q parameter of %s type has a non-numeric element", k, typ))
+			} else {
+				errs = append(errs, fmt.Errorf("value %q of %q parameter of %s type has a non-numeric element %q", v, k, typ, e))
+			}
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withMaskedParams returns noEcho with parameters the stack reports masked
+// values of added, so that their new values are hidden even if the template
+// doesn't tell they are NoEcho. Nil noEcho is returned as is, as it already
+// hides all values.
+func withMaskedParams(noEcho map[string]bool, existing []types.Parameter) map[string]bool {
+	if noEcho == nil {
+		return nil
+	}
+	out := maps.Clone(noEcho)
+	for _, p := range existing {
+		if unptr(p.ParameterValue) == noEchoMask {
+			out[unptr(p.ParameterKey)] = true
+		}
+	}
+	return out
+}
+
+// redact returns value of the parameter k suitable for logging, hiding it
+// if the parameter is NoEcho. If noEcho is nil, all values are hidden.
+func redact(noEcho map[string]bool, k, value string) string {
+	if noEcho == nil || noEcho[k] || value == noEchoMask {
+		return "***"
+	}
+	return value
+}
+
+// printParamsDiff writes to w the old and new values of parameters that are
+// set or deleted, redacting the values of NoEcho parameters.
+func printParamsDiff(w io.Writer, stackName string, existing []types.Parameter, set map[string]string, toDelete map[string]struct{}, noEcho map[string]bool) {
+	fmt.Fprintf(w, "parameter changes for %s stack:\n", stackName)
+	noEcho = withMaskedParams(noEcho, existing)
+	for _, p := range existing {
+		k, old := unptr(p.ParameterKey), unptr(p.ParameterValue)
+		if _, ok := toDelete[k]; ok {
+			fmt.Fprintf(w, "  %s: %q -> (deleted)\n", k, redact(noEcho, k, old))
+			continue
+		}
+		v, ok := set[k]
+		if !ok {
+			continue
+		}
+		switch {
+		case old == v:
+			fmt.Fprintf(w, "  %s: %q (unchanged)\n", k, redact(noEcho, k, v))
+		default:
+			fmt.Fprintf(w, "  %s: %q -> %q\n", k, redact(noEcho, k, old), redact(noEcho, k, v))
+		}
+	}
+}
+
+// updateStackInput returns UpdateStack call input with the given parameters
+// and tags to set, preserving other settings of the existing stack unless
+// opts override them.
+func updateStackInput(opts Options, stack *types.Stack, params []types.Parameter, tags map[string]string, token string) *cloudformation.UpdateStackInput {
+	input := &cloudformation.UpdateStackInput{
+		StackName:           stack.StackName,
+		ClientRequestToken:  &token,
+		UsePreviousTemplate: ptr(true),
+		Parameters:          params,
+		Capabilities:        stack.Capabilities,
+		NotificationARNs:    stack.NotificationARNs,
+	}
+	if opts.NoRollback {
+		input.DisableRollback = ptr(true)
+	}
+	input.RollbackConfiguration = rollbackConfiguration(stack.RollbackConfiguration, opts.RollbackMinutes, opts.RollbackTriggers)
+	if opts.Capabilities != nil {
+		input.Capabilities = opts.Capabilities
+	}
+	if opts.NotificationARNs != nil {
+		input.NotificationARNs = opts.NotificationARNs
+	}
+	if len(tags) != 0 || len(opts.TagsToRemove) != 0 {
+		input.Tags = mergeTags(stack.Tags, tags, opts.TagsToRemove)
+	}
+	return input
+}
+
+// rollbackConfiguration returns existing stack rollback configuration with
+// monitoring time and triggers replaced by the ones given, if any.
+func rollbackConfiguration(existing *types.RollbackConfiguration, minutes *int32, triggerARNs []string) *types.RollbackConfiguration {
+	if minutes == nil && len(triggerARNs) == 0 {
+		return existing
+	}
+	var out types.RollbackConfiguration
+	if existing != nil {
+		out = *existing
+	}
+	if minutes != nil {
+		out.MonitoringTimeInMinutes = minutes
+	}
+	if len(triggerARNs) != 0 {
+		out.RollbackTriggers = nil
+		for _, arn := range triggerARNs {
+			out.RollbackTriggers = append(out.RollbackTriggers, types.RollbackTrigger{
+				Arn:  ptr(arn),
+				Type: ptr("AWS::CloudWatch::Alarm"),
+			})
+		}
+	}
+	return &out
+}
+
+// isSNSTopicARN reports whether s looks like an SNS topic ARN, e.g.
+// arn:aws:sns:us-east-1:123456789012:topic.
+func isSNSTopicARN(s string) bool {
+	fields := strings.SplitN(s, ":", 6)
+	return len(fields) == 6 && fields[0] == "arn" && fields[1] != "" && fields[2] == "sns" && fields[5] != ""
+}
+
+// mergeTags returns existing tags overridden by tags from set, with tags
+// from remove dropped. The result is sorted by tag key.
+func mergeTags(existing []types.Tag, set map[string]string, remove []string) []types.Tag {
+	m := make(map[string]string, len(existing)+len(set))
+	for _, t := range existing {
+		m[unptr(t.Key)] = unptr(t.Value)
+	}
+	maps.Copy(m, set)
+	for _, k := range remove {
+		if _, ok := m[k]; !ok {
+			debugf("tag %q to remove is not set on the stack", k)
+		}
+		delete(m, k)
+	}
+	// must be non-nil even if empty: UpdateStack with an empty list
+	// removes all tags, while nil list keeps existing ones
+	out := make([]types.Tag, 0, len(m))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		out = append(out, types.Tag{Key: ptr(k), Value: ptr(m[k])})
+	}
+	return out
+}
+
+// stackTemplate returns the original template of the named stack, as it was
+// submitted, before any transforms were processed.
+func stackTemplate(ctx context.Context, svc CloudFormationAPI, stackName string) (string, error) {
+	out, err := svc.GetTemplate(ctx, &cloudformation.GetTemplateInput{
+		StackName:     &stackName,
+		TemplateStage: types.TemplateStageOriginal,
+	})
+	if err != nil {
+		return "", fmt.Errorf("reading template of %s stack: %w", stackName, err)
+	}
+	body := unptr(out.TemplateBody)
+	if body == "" {
+		return "", fmt.Errorf("template of %s stack is empty", stackName)
+	}
+	if len(body) > maxTemplateBodySize {
+		return "", fmt.Errorf("template of %s stack is %d bytes, over the %d bytes limit for inline templates; upload it to S3 and use -template-url instead",
+			stackName, len(body), maxTemplateBodySize)
+	}
+	return body, nil
+}
+
+// maxTemplateBodySize is the maximum size of a template body that can be
+// passed directly in the API call.
+const maxTemplateBodySize = 51200
+
+// readTemplate reads template body from the named file.
+func readTemplate(name string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("reading template: %w", err)
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return "", fmt.Errorf("template file %q is empty", name)
+	}
+	if len(b) > maxTemplateBodySize {
+		return "", fmt.Errorf("template file %q is %d bytes, over the %d bytes limit for inline templates; upload it to S3 and use -template-url instead",
+			name, len(b), maxTemplateBodySize)
+	}
+	return string(b), nil
+}
+
+// readStackPolicy reads stack policy from the named file, making sure it's
+// a valid JSON.
+func readStackPolicy(name string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("reading stack policy: %w", err)
+	}
+	if !json.Valid(b) {
+		return "", fmt.Errorf("stack policy file %q is not a valid JSON", name)
+	}
+	return string(b), nil
+}
+
+// readResourcesToImport reads a JSON list of resources to import, in the
+// format of the --resources-to-import option of AWS CLI.
+func readResourcesToImport(name string) ([]types.ResourceToImport, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading resources to import: %w", err)
+	}
+	var resources []types.ResourceToImport
+	if err := json.Unmarshal(b, &resources); err != nil {
+		return nil, fmt.Errorf("resources to import file %q: %w", name, err)
+	}
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("resources to import file %q has no resources", name)
+	}
+	for i, r := range resources {
+		if unptr(r.ResourceType) == "" || unptr(r.LogicalResourceId) == "" || len(r.ResourceIdentifier) == 0 {
+			return nil, fmt.Errorf("resources to import file %q: resource #%d must have ResourceType, LogicalResourceId, and ResourceIdentifier set", name, i+1)
+		}
+	}
+	return resources, nil
+}
+
+// loadConfig loads AWS configuration, assuming the role set in opts
+// if necessary.
+func loadConfig(ctx context.Context, opts Options) (aws.Config, error) {
+	if opts.UseFIPS && opts.EndpointURL != "" {
+		return aws.Config{}, withKind(errUsage, errors.New("-use-fips cannot be used with -endpoint-url"))
+	}
+	if opts.DualStack && opts.EndpointURL != "" {
+		return aws.Config{}, withKind(errUsage, errors.New("-dualstack cannot be used with -endpoint-url"))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions(opts)...)
+	if err != nil {
+		return cfg, err
+	}
+	if opts.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = opts.RoleSessionName
+			if opts.ExternalID != "" {
+				o.ExternalID = &opts.ExternalID
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return cfg, nil
+}
+
+// loadOptions returns options for config.LoadDefaultConfig that apply
+// AWS-specific settings from opts.
+func loadOptions(opts Options) []func(*config.LoadOptions) error {
+	out := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			// large stacks polled for a long time can hit API rate limits,
+			// so retry harder than the SDK default does
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = 10
+				o.MaxBackoff = 30 * time.Second
+				o.RateLimiter = ratelimit.None
+			})
+		}),
+	}
+	if opts.Region != "" {
+		out = append(out, config.WithRegion(opts.Region))
+	}
+	if opts.Profile != "" {
+		out = append(out, config.WithSharedConfigProfile(opts.Profile))
+	}
+	if opts.EndpointURL != "" {
+		out = append(out, config.WithBaseEndpoint(opts.EndpointURL))
+	}
+	if opts.UseFIPS {
+		out = append(out, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if opts.DualStack {
+		out = append(out, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	return out
+}
+
+// newClient returns CloudFormation client for cfg. The SDK lets the
+// AWS_ENDPOINT_URL_CLOUDFORMATION environment variable override the endpoint
+// set in cfg, while -endpoint-url is meant to take precedence.
+func newClient(cfg aws.Config, opts Options) *cloudformation.Client {
+	return cloudformation.NewFromConfig(cfg, func(o *cloudformation.Options) {
+		if opts.EndpointURL != "" {
+			o.BaseEndpoint = &opts.EndpointURL
+		}
+	})
+}
+
+// describeParams prints current parameters of the stack to stdout, redacting
+// values of NoEcho ones. If withName is set, output starts with the stack
+// name.
+func describeParams(ctx context.Context, svc CloudFormationAPI, stackName string, withName bool) error {
+	stack, err := describeStack(ctx, svc, stackName)
+	if err != nil {
+		return err
+	}
+	decls, err := templateParameters(ctx, svc, templateSummaryInput(stackName, "", ""))
+	if err != nil {
+		warnf("cannot tell which parameters are NoEcho, all values are redacted: %v", err)
+	}
+	noEcho := noEchoParameters(decls)
+	if withName {
+		fmt.Printf("%s:\n", cmp.Or(unptr(stack.StackName), stackName))
+	}
+	printParams(os.Stdout, stack.Parameters, noEcho)
+	return nil
+}
+
+// describeEvents writes a table of all events of the named stack that
+// belong to the operation with the given client request token, oldest first.
+func describeEvents(ctx context.Context, svc CloudFormationAPI, w io.Writer, stackName, token string) error {
+	events, err := stackEvents(ctx, svc, stackName, []string{token}, time.Time{})
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("stack %s has no events with %q client request token", stackName, token)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tLOGICAL ID\tRESOURCE TYPE\tSTATUS\tREASON")
+	for _, evt := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n", unptr(evt.Timestamp).UTC().Format(time.RFC3339), unptr(evt.LogicalResourceId),
+			unptr(evt.ResourceType), evt.ResourceStatus, unptr(evt.ResourceStatusReason))
+	}
+	return tw.Flush()
+}
+
+// printParams writes a table of parameter keys and values to w, keys sorted
+func printParams(w io.Writer, params []types.Parameter, noEcho map[string]bool) {
+	params = slices.Clone(params)
+	slices.SortFunc(params, func(a, b types.Parameter) int {
+		return cmp.Compare(unptr(a.ParameterKey), unptr(b.ParameterKey))
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE")
+	for _, p := range params {
+		k := unptr(p.ParameterKey)
+		fmt.Fprintf(tw, "%s\t%s\n", k, redact(noEcho, k, unptr(p.ParameterValue)))
+	}
+	tw.Flush()
+}
+
+// printOutputs writes stack outputs to w as a JSON object keyed by output
+// names.
+func printOutputs(w io.Writer, outputs []types.Output) error {
+	type output struct {
+		Value       string `json:"value"`
+		Description string `json:"description,omitempty"`
+		ExportName  string `json:"exportName,omitempty"`
+	}
+	out := make(map[string]output, len(outputs))
+	for _, o := range outputs {
+		if o.OutputKey == nil {
+			continue
+		}
+		out[*o.OutputKey] = output{
+			Value:       unptr(o.OutputValue),
+			Description: unptr(o.Description),
+			ExportName:  unptr(o.ExportName),
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// writeGithubOutputs appends stack outputs to the file used for GitHub
+// Actions step outputs.
+func writeGithubOutputs(name string, outputs []types.Output) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, o := range outputs {
+		if o.OutputKey == nil {
+			continue
+		}
+		if err := githubOutput(f, *o.OutputKey, unptr(o.OutputValue)); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// githubOutput writes a single key-value pair in the GitHub Actions output
+// file format, using the multiline syntax for values containing newlines.
+// Characters not allowed in output names are replaced with underscores.
+func githubOutput(w io.Writer, key, value string) error {
+	key = githubOutputName(key)
+	if !strings.ContainsAny(value, "\r\n") {
+		_, err := fmt.Fprintf(w, "%s=%s\n", key, value)
+		return err
+	}
+	delim := "ghadelimiter_" + newToken("")
+	for strings.Contains(value, delim) {
+		delim = "ghadelimiter_" + newToken("")
+	}
+	_, err := fmt.Fprintf(w, "%s<<%s\n%s\n%s\n", key, delim, value, delim)
+	return err
+}
+
+func githubOutputName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_', c == '-':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// retryableReasons match resource failure reasons that are likely caused by
+// eventual consistency or service hiccups, so the same update may succeed
+// when retried.
+var retryableReasons = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)role .* cannot be assumed`),
+	regexp.MustCompile(`(?i)invalid principal in policy`),
+	regexp.MustCompile(`(?i)\b(throttling|rate exceeded|too many requests)\b`),
+	regexp.MustCompile(`(?i)\b(internal ?failure|service ?unavailable|internal server error)\b`),
+}
+
+// isRetryableFailure reports whether err looks like a transient failure
+// matching one of retryableReasons.
+func isRetryableFailure(err error) bool {
+	msg := err.Error()
+	for _, re := range retryableReasons {
+		if re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTokenLength is the maximum length of ClientRequestToken
+const maxTokenLength = 128
+
+// validToken reports whether s is a valid ClientRequestToken value.
+func validToken(s string) bool {
+	return len(s) <= maxTokenLength && tokenRe.MatchString(s)
+}
+
+var tokenRe = regexp.MustCompile(`^[a-zA-Z0-9][-a-zA-Z0-9]*$`)
+
+// newToken returns a random client request token starting with prefix.
+func newToken(prefix string) string {
+	b := make([]byte, tokenRandomBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return prefix + hex.EncodeToString(b)
+}
+
+// tokenRandomBytes is how many random bytes newToken encodes
+const tokenRandomBytes = 20
+
+// defaultTokenPrefix is the prefix of client request tokens the tool
+// generates, unless configured otherwise
+const defaultTokenPrefix = "ucs-"
+
+var underGithub bool
+var githubWarnPrefix string
+var githubErrPrefix string
+
+func init() {
+	underGithub = os.Getenv("GITHUB_ACTIONS") == "true"
+	if underGithub {
+		githubLog = true
+		githubWarnPrefix = "::warning::"
+		githubErrPrefix = "::error::"
+	}
+}
+
+// parseKvs parses a list of Key=Value pairs. Value starting with @ is treated
+// as a name of the file to load the value from; use @@ for values that need
+// to start with a literal @. Empty values are only accepted if allowEmpty is
+// set.
+func parseKvs(list []string, allowEmpty bool) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, line := range list {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("wrong parameter format, want key=value pair: %q", line)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if k == "" || v == "" && !allowEmpty {
+			return nil, fmt.Errorf("wrong parameter format, both key and value must be non-empty: %q", line)
+		}
+		switch {
+		case strings.HasPrefix(v, "@@"):
+			v = v[1:]
+		case strings.HasPrefix(v, "@"):
+			b, err := os.ReadFile(v[1:])
+			if err != nil {
+				return nil, fmt.Errorf("reading value of %q parameter: %w", k, err)
+			}
+			if v = string(b); v == "" {
+				return nil, fmt.Errorf("value of %q parameter loaded from file is empty", k)
+			}
+		}
+		// duplicates are fine as long as they agree, e.g. when a params
+		// file repeats defaults set elsewhere
+		if old, ok := out[k]; ok && old != v {
+			return nil, fmt.Errorf("conflicting values of %q key in parameters list: %q and %q", k, old, v)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// parseTags parses Key=Value pairs of tags. Unlike parameter values, tag
+// values never refer to files, so a value starting with @ is taken as is.
+func parseTags(list []string) (map[string]string, error) {
+	out := make(map[string]string, len(list))
+	for _, kv := range list {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("wrong tag format, want non-empty key and value separated by =: %q", kv)
+		}
+		if old, ok := out[k]; ok && old != v {
+			return nil, fmt.Errorf("conflicting values of %q tag: %q and %q", k, old, v)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// expandEnv replaces ${VAR} and $VAR references in values of Key=Value pairs
+// with values returned by lookup, and $$ with a single $. Referencing a
+// variable that is not set is an error.
+func expandEnv(list []string, lookup func(string) (string, bool)) ([]string, error) {
+	out := make([]string, len(list))
+	var missing []string
+	for i, kv := range list {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			out[i] = kv // reported by parseKvs
+			continue
+		}
+		out[i] = k + "=" + os.Expand(v, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			val, ok := lookup(name)
+			if !ok && !slices.Contains(missing, name) {
+				missing = append(missing, name)
+			}
+			return val
+		})
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("parameter values refer to environment variables that are not set: %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// readParamsFile reads parameters from the named file in the format accepted
+// by parseKvs: newline-separated Key=Value pairs, lines starting with # are
+// skipped. Files with the .json extension are parsed as a JSON object instead.
+// Name "-" stands for stdin, which is parsed as JSON if it starts with {.
+func readParamsFile(name string) ([]string, error) {
+	var b []byte
+	var err error
+	if name == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading parameters file: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(name), ".json") || name == "-" && bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		out, err := jsonParams(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing parameters file %q: %w", name, err)
+		}
+		return out, nil
+	}
+	var out []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, nil
+}
+
+// inputParams returns Key=Value pairs from the parameters input of the
+// GitHub Action, which is either a YAML mapping or a list of lines.
+func inputParams(input string) ([]string, error) {
+	lines, ok, err := yamlParams(input)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("parsing parameters input: %w", err)
+	case ok:
+		return lines, nil
+	}
+	return strings.Split(input, "\n"), nil
+}
+
+// yamlParams converts YAML (or JSON) mapping into a list of Key=Value pairs,
+// keeping scalar values exactly as written, e.g. 1.10 stays 1.10. It reports
+// false if s is not a mapping, or has keys with =, as then it's likely
+// a list of Key=Value lines, some of them containing ": ".
+func yamlParams(s string) ([]string, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(s), &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, false, nil
+	}
+	m := doc.Content[0]
+	for i := 0; i < len(m.Content); i += 2 {
+		if strings.Contains(m.Content[i].Value, "=") {
+			return nil, false, nil
+		}
+	}
+	var out []string
+	for i := 0; i < len(m.Content); i += 2 {
+		k, v := m.Content[i].Value, m.Content[i+1]
+		if v.Kind != yaml.ScalarNode {
+			return nil, false, fmt.Errorf("value of %q must be a string, number, or boolean", k)
+		}
+		val := v.Value
+		if v.Tag == "!!null" {
+			val = ""
+		}
+		if strings.HasPrefix(val, "@") {
+			val = "@" + val // YAML values are always literal, see parseKvs
+		}
+		out = append(out, k+"="+val)
+	}
+	return out, true, nil
+}
+
+// jsonParams converts JSON object into a list of Key=Value pairs. Numbers
+// and booleans are converted to their string form, as that's how
+// CloudFormation treats all parameter values.
+func jsonParams(b []byte) ([]string, error) {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		var v string
+		switch x := m[k].(type) {
+		case string:
+			v = x
+		case json.Number:
+			v = x.String()
+		case bool:
+			v = strconv.FormatBool(x)
+		default:
+			return nil, fmt.Errorf("value of %q must be a string, number, or boolean", k)
+		}
+		if strings.HasPrefix(v, "@") {
+			v = "@" + v // JSON values are always literal, see parseKvs
+		}
+		out = append(out, k+"="+v)
+	}
+	return out, nil
+}
+
+func ptr[T any](v T) *T { return &v }
+func unptr[T any](v *T) T {
+	var zero T
+	if v != nil {
+		return *v
+	}
+	return zero
+}
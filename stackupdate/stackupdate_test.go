@@ -0,0 +1,2254 @@
+package stackupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/smithy-go"
+)
+
+func Test_parseKvs(t *testing.T) {
+	dir := t.TempDir()
+	valueFile := filepath.Join(dir, "value.txt")
+	if err := os.WriteFile(valueFile, []byte("value from file\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.txt")
+	if err := os.WriteFile(emptyFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		input       []string
+		allowEmpty  bool
+		pairsParsed int
+		wantErr     bool
+	}{
+		{input: nil},
+		{input: []string{"\n"}},
+		{input: []string{"k=v"}, pairsParsed: 1},
+		{input: []string{"k=v", "k=v"}, pairsParsed: 1},
+		{input: []string{"k=v", "k=v2"}, wantErr: true},
+		{input: []string{"k=v", "k2=v"}, pairsParsed: 2},
+		{input: []string{"k=v", "", "k2=v", ""}, pairsParsed: 2},
+		{input: []string{"k=v", "k2=v", "k=v"}, pairsParsed: 2},
+		{input: []string{"k=v", "k2=v", " k = v2"}, wantErr: true},
+		{input: []string{"k=v", "junk"}, wantErr: true},
+		{input: []string{"k= ", "k2=v"}, wantErr: true},
+		{input: []string{"k= ", "k2=v"}, allowEmpty: true, pairsParsed: 2},
+		{input: []string{"=v"}, allowEmpty: true, wantErr: true},
+		{input: []string{"k=@" + emptyFile}, allowEmpty: true, wantErr: true},
+		{input: []string{"k=@" + valueFile}, pairsParsed: 1},
+		{input: []string{"k=@" + emptyFile}, wantErr: true},
+		{input: []string{"k=@" + filepath.Join(dir, "missing.txt")}, wantErr: true},
+		{input: []string{"k=@@" + filepath.Join(dir, "missing.txt")}, pairsParsed: 1},
+	} {
+		got, err := parseKvs(tc.input, tc.allowEmpty)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("input: %q, want error: %v, got error: %v", tc.input, tc.wantErr, err)
+		}
+		if l := len(got); l != tc.pairsParsed {
+			t.Errorf("input: %q, got %d kv pairs, want %d", tc.input, l, tc.pairsParsed)
+		}
+	}
+}
+
+func Test_parseTags(t *testing.T) {
+	got, err := parseTags([]string{"Owner=@alice", "Team = platform", "Team=platform"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"Owner": "@alice", "Team": "platform"}; !maps.Equal(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+	for _, input := range [][]string{{"Owner"}, {"=alice"}, {"Owner="}, {"Owner=alice", "Owner=bob"}} {
+		if _, err := parseTags(input); err == nil {
+			t.Errorf("input: %q, got no error", input)
+		}
+	}
+}
+
+func Test_parseKvsValues(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cert.pem")
+	const pem = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	if err := os.WriteFile(name, []byte(pem), 0666); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseKvs([]string{"Cert=@" + name, "Handle=@@user"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Cert": pem, "Handle": "@user"}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func Test_parseKvsLists(t *testing.T) {
+	got, err := parseKvs([]string{"Subnets=subnet-1,subnet-2", "Ports=80, 443", "Query=a=1,b=2"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Subnets": "subnet-1,subnet-2", "Ports": "80, 443", "Query": "a=1,b=2"}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func Test_readParamsFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "params.txt")
+	const body = "# comment\nk=v\n\n  # indented comment\nk2=v2\n"
+	if err := os.WriteFile(name, []byte(body), 0666); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := readParamsFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseKvs(append(lines, "k3=v3"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"k": "v", "k2": "v2", "k3": "v3"}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := parseKvs(append(lines, "k=other"), false); err == nil {
+		t.Error("duplicate key across file and arguments should be rejected")
+	}
+}
+
+func Test_newClient(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_ENDPOINT_URL_CLOUDFORMATION", "http://localhost:4567")
+	for _, tc := range []struct {
+		endpointURL, want string
+	}{
+		{"", "http://localhost:4567"},
+		{"http://localhost:4566", "http://localhost:4566"},
+	} {
+		opts := Options{Region: "eu-west-1", EndpointURL: tc.endpointURL}
+		cfg, err := config.LoadDefaultConfig(context.Background(), loadOptions(opts)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := unptr(newClient(cfg, opts).Options().BaseEndpoint); got != tc.want {
+			t.Errorf("with -endpoint-url=%q got endpoint %q, want %q", tc.endpointURL, got, tc.want)
+		}
+	}
+}
+
+func Test_loadOptions(t *testing.T) {
+	var lo config.LoadOptions
+	for _, fn := range loadOptions(Options{Region: "eu-west-1", Profile: "deploy", EndpointURL: "http://localhost:4566", UseFIPS: true, DualStack: true}) {
+		if err := fn(&lo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lo.Region != "eu-west-1" {
+		t.Errorf("got region %q, want %q", lo.Region, "eu-west-1")
+	}
+	if lo.SharedConfigProfile != "deploy" {
+		t.Errorf("got profile %q, want %q", lo.SharedConfigProfile, "deploy")
+	}
+	if lo.BaseEndpoint != "http://localhost:4566" {
+		t.Errorf("got endpoint %q, want %q", lo.BaseEndpoint, "http://localhost:4566")
+	}
+	if lo.UseFIPSEndpoint != aws.FIPSEndpointStateEnabled {
+		t.Errorf("got FIPS endpoint state %v, want enabled", lo.UseFIPSEndpoint)
+	}
+	if lo.UseDualStackEndpoint != aws.DualStackEndpointStateEnabled {
+		t.Errorf("got dual-stack endpoint state %v, want enabled", lo.UseDualStackEndpoint)
+	}
+	if lo.Retryer == nil {
+		t.Fatal("retryer is not set")
+	}
+	if n := lo.Retryer().MaxAttempts(); n != 10 {
+		t.Errorf("got retryer with %d max attempts, want 10", n)
+	}
+}
+
+func Test_githubOutput(t *testing.T) {
+	var buf strings.Builder
+	if err := githubOutput(&buf, "Bucket.Name", "my-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Bucket_Name=my-bucket\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	buf.Reset()
+	if err := githubOutput(&buf, "Config", "line1\nline2"); err != nil {
+		t.Fatal(err)
+	}
+	name, rest, ok := strings.Cut(buf.String(), "<<")
+	if !ok || name != "Config" {
+		t.Fatalf("unexpected multiline output: %q", buf.String())
+	}
+	delim, _, _ := strings.Cut(rest, "\n")
+	if want := "Config<<" + delim + "\nline1\nline2\n" + delim + "\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func Test_progress(t *testing.T) {
+	p := progress{
+		"Bucket":   types.ResourceStatusUpdateComplete,
+		"Queue":    types.ResourceStatusUpdateInProgress,
+		"Role":     types.ResourceStatusDeleteSkipped,
+		"Function": types.ResourceStatusUpdateFailed,
+	}
+	if got, want := p.String(), "2/4 resources complete, 1 in progress, 1 failed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := p.format(true), "\x1b[32m2\x1b[0m/4 resources complete, \x1b[33m1\x1b[0m in progress, \x1b[31m1 failed\x1b[0m"; got != want {
+		t.Errorf("colored: got %q, want %q", got, want)
+	}
+	delete(p, "Function")
+	if got, want := p.String(), "2/3 resources complete, 1 in progress"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func Test_statusColor(t *testing.T) {
+	for status, want := range map[types.ResourceStatus]string{
+		types.ResourceStatusUpdateComplete:           colorGreen,
+		types.ResourceStatusCreateComplete:           colorGreen,
+		types.ResourceStatusUpdateInProgress:         colorYellow,
+		types.ResourceStatusUpdateFailed:             colorRed,
+		types.ResourceStatusUpdateRollbackInProgress: colorRed,
+		types.ResourceStatusUpdateRollbackComplete:   colorRed,
+	} {
+		if got := statusColor(status); got != want {
+			t.Errorf("statusColor(%v) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func Test_setOutputFormat(t *testing.T) {
+	t.Cleanup(func() { setOutputFormat("text", "text") })
+	if err := setOutputFormat("github", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !githubLog || githubWarnPrefix != "::warning::" || jsonLogger != nil {
+		t.Errorf("github: githubLog=%v, githubWarnPrefix=%q, jsonLogger=%v", githubLog, githubWarnPrefix, jsonLogger)
+	}
+	if err := setOutputFormat("text", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if githubLog || githubWarnPrefix != "" || githubErrPrefix != "" {
+		t.Errorf("text: githubLog=%v, githubWarnPrefix=%q, githubErrPrefix=%q", githubLog, githubWarnPrefix, githubErrPrefix)
+	}
+	if err := setOutputFormat("json", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if githubLog || jsonLogger == nil {
+		t.Errorf("json: githubLog=%v, jsonLogger=%v", githubLog, jsonLogger)
+	}
+	for _, tc := range [][2]string{{"github", "json"}, {"text", "json"}, {"yaml", "text"}} {
+		if err := setOutputFormat(tc[0], tc[1]); err == nil {
+			t.Errorf("setOutputFormat(%q, %q) succeeded, want error", tc[0], tc[1])
+		}
+	}
+}
+
+func Test_mergeTags(t *testing.T) {
+	existing := []types.Tag{
+		{Key: ptr("env"), Value: ptr("prod")},
+		{Key: ptr("owner"), Value: ptr("alice")},
+		{Key: ptr("team"), Value: ptr("infra")},
+	}
+	got := mergeTags(existing, map[string]string{"owner": "bob", "cost": "42"}, []string{"team", "missing"})
+	var gotKvs []string
+	for _, t := range got {
+		gotKvs = append(gotKvs, *t.Key+"="+*t.Value)
+	}
+	want := []string{"cost=42", "env=prod", "owner=bob"}
+	if !slices.Equal(gotKvs, want) {
+		t.Errorf("got %q, want %q", gotKvs, want)
+	}
+	if got := mergeTags(existing[:1], nil, []string{"env"}); got == nil || len(got) != 0 {
+		t.Errorf("removing all tags should produce empty non-nil list, got %#v", got)
+	}
+}
+
+func Test_parseCapabilities(t *testing.T) {
+	got, err := parseCapabilities("CAPABILITY_IAM, CAPABILITY_AUTO_EXPAND,CAPABILITY_IAM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.Capability{types.CapabilityCapabilityIam, types.CapabilityCapabilityAutoExpand}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, err := parseCapabilities(""); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("empty list: got %#v, %v; want empty non-nil slice", got, err)
+	}
+	if _, err := parseCapabilities("CAPABILITY_IAM,CAPABILITY_ROOT"); err == nil {
+		t.Error("unknown capability should be rejected")
+	}
+}
+
+func Test_readParamsFileJSON(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "params.json")
+	const body = `{"Name": "app", "Count": 3, "Ratio": 0.5, "Enabled": true, "Handle": "@user"}`
+	if err := os.WriteFile(name, []byte(body), 0666); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := readParamsFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseKvs(lines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Name": "app", "Count": "3", "Ratio": "0.5", "Enabled": "true", "Handle": "@user"}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := os.WriteFile(name, []byte(`{"List": ["a", "b"]}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readParamsFile(name); err == nil {
+		t.Error("non-scalar value should be rejected")
+	}
+}
+
+func Test_updateStackInput(t *testing.T) {
+	stack := &types.Stack{
+		StackName:        ptr("my-stack"),
+		Capabilities:     []types.Capability{types.CapabilityCapabilityIam},
+		NotificationARNs: []string{"arn:aws:sns:us-east-1:123456789012:events"},
+		RollbackConfiguration: &types.RollbackConfiguration{
+			MonitoringTimeInMinutes: ptr(int32(10)),
+			RollbackTriggers: []types.RollbackTrigger{{
+				Arn:  ptr("arn:aws:cloudwatch:us-east-1:123456789012:alarm:errors"),
+				Type: ptr("AWS::CloudWatch::Alarm"),
+			}},
+		},
+	}
+	input := updateStackInput(Options{}, stack, nil, nil, "token")
+	if input.RollbackConfiguration != stack.RollbackConfiguration {
+		t.Errorf("rollback configuration is not preserved: got %+v, want %+v", input.RollbackConfiguration, stack.RollbackConfiguration)
+	}
+	if !slices.Equal(input.Capabilities, stack.Capabilities) {
+		t.Errorf("capabilities are not preserved: got %v, want %v", input.Capabilities, stack.Capabilities)
+	}
+	if !slices.Equal(input.NotificationARNs, stack.NotificationARNs) {
+		t.Errorf("notification ARNs are not preserved: got %v, want %v", input.NotificationARNs, stack.NotificationARNs)
+	}
+	if input.Tags != nil {
+		t.Errorf("tags should be left unset, got %v", input.Tags)
+	}
+
+	input = updateStackInput(Options{RollbackMinutes: ptr(int32(30))}, stack, nil, nil, "token")
+	rc := input.RollbackConfiguration
+	if rc == nil || unptr(rc.MonitoringTimeInMinutes) != 30 || len(rc.RollbackTriggers) != 1 {
+		t.Errorf("rollback monitoring time should be overridden keeping triggers, got %+v", rc)
+	}
+	if unptr(stack.RollbackConfiguration.MonitoringTimeInMinutes) != 10 {
+		t.Error("existing stack rollback configuration was modified")
+	}
+}
+
+func Test_validToken(t *testing.T) {
+	for _, tc := range []struct {
+		token string
+		want  bool
+	}{
+		{token: newToken(defaultTokenPrefix), want: true},
+		{token: "Deploy-123", want: true},
+		{token: strings.Repeat("a", 128), want: true},
+		{token: strings.Repeat("a", 129)},
+		{token: ""},
+		{token: "-leading-hyphen"},
+		{token: "has_underscore"},
+		{token: "has space"},
+	} {
+		if got := validToken(tc.token); got != tc.want {
+			t.Errorf("validToken(%q) = %v, want %v", tc.token, got, tc.want)
+		}
+	}
+}
+
+func Test_printParamsDiff(t *testing.T) {
+	existing := []types.Parameter{
+		{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+		{ParameterKey: ptr("Password"), ParameterValue: ptr(noEchoMask)},
+		{ParameterKey: ptr("ApiKey"), ParameterValue: ptr(noEchoMask)},
+		{ParameterKey: ptr("Size"), ParameterValue: ptr("10")},
+		{ParameterKey: ptr("Legacy"), ParameterValue: ptr("yes")},
+		{ParameterKey: ptr("Untouched"), ParameterValue: ptr("x")},
+	}
+	set := map[string]string{"ImageTag": "v2", "Password": "hunter2", "ApiKey": "secret", "Size": "10"}
+	var buf strings.Builder
+	printParamsDiff(&buf, "my-stack", existing, set, map[string]struct{}{"Legacy": {}}, map[string]bool{"Password": true})
+	const want = `parameter changes for my-stack stack:
+  ImageTag: "v1" -> "v2"
+  Password: "***" -> "***"
+  ApiKey: "***" -> "***"
+  Size: "10" (unchanged)
+  Legacy: "yes" -> (deleted)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	buf.Reset()
+	printParamsDiff(&buf, "my-stack", existing[:1], set, nil, nil)
+	if got, want := buf.String(), "parameter changes for my-stack stack:\n  ImageTag: \"***\" -> \"***\"\n"; got != want {
+		t.Errorf("with unknown NoEcho parameters got %q, want %q", got, want)
+	}
+}
+
+func Test_printParams(t *testing.T) {
+	params := []types.Parameter{
+		{ParameterKey: ptr("Size"), ParameterValue: ptr("10")},
+		{ParameterKey: ptr("Password"), ParameterValue: ptr(noEchoMask)},
+		{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+	}
+	var buf strings.Builder
+	printParams(&buf, params, map[string]bool{"Password": true})
+	const want = "KEY       VALUE\nImageTag  v1\nPassword  ***\nSize      10\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_exitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{err: nil, want: 0},
+		{err: errNoUpdates, want: 0},
+		{err: errors.New("boom"), want: exitFailure},
+		{err: withKind(errUsage, errors.New("empty parameters list")), want: exitUsage},
+		{err: withKind(errTimeout, errors.New("timed out")), want: exitTimeout},
+		{err: fmt.Errorf("my-stack: %w", withKind(errUpdateFailed, errors.New("rolled back"))), want: exitUpdateFailed},
+		{err: errors.Join(errors.New("other"), withKind(errUsage, errors.New("bad"))), want: exitUsage},
+		{err: withKind(errInterrupted, errors.New("deadline exceeded")), want: exitInterrupted},
+		{err: fmt.Errorf("describing stack: %w", context.Canceled), want: exitInterrupted},
+	} {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+	if err := withKind(errUsage, errors.New("message")); err.Error() != "message" {
+		t.Errorf("withKind changed error message to %q", err)
+	}
+}
+
+func Test_consoleURL(t *testing.T) {
+	const id = "arn:aws:cloudformation:eu-west-1:123456789012:stack/my-stack/0b1c2d3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e"
+	const want = "https://eu-west-1.console.aws.amazon.com/cloudformation/home?region=eu-west-1#/stacks/events?stackId=" +
+		"arn%3Aaws%3Acloudformation%3Aeu-west-1%3A123456789012%3Astack%2Fmy-stack%2F0b1c2d3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e"
+	if got := consoleURL("eu-west-1", id); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func Test_prepareUpdateRefs(t *testing.T) {
+	opts := Options{
+		StackNames:    []string{"stack"},
+		PollInterval:  minPollInterval,
+		MaxAttempts:   1,
+		LiteralParams: []string{"Literal=ssm:/not/a/ref"},
+	}
+	upd, err := prepareUpdate(opts, []string{"Ref=ssm:/app/db-host", "Plain=value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]struct{}{"Ref": {}}; !maps.Equal(upd.refs, want) {
+		t.Fatalf("got refs %v, want %v", upd.refs, want)
+	}
+}
+
+func Test_prepareUpdateTokenPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		valid  bool
+	}{
+		{"", true},
+		{"deploy-", true},
+		{strings.Repeat("a", maxTokenLength-2*tokenRandomBytes), true},
+		{strings.Repeat("a", maxTokenLength-2*tokenRandomBytes+1), false},
+		{"-deploy", false},
+		{"deploy_", false},
+	} {
+		opts := Options{StackNames: []string{"stack"}, PollInterval: minPollInterval, MaxAttempts: 1, TokenPrefix: tc.prefix}
+		if _, err := prepareUpdate(opts, []string{"Key=value"}); (err == nil) != tc.valid {
+			t.Errorf("prefix %q: got error %v, want valid: %v", tc.prefix, err, tc.valid)
+		}
+	}
+}
+
+func Test_parseSecretRef(t *testing.T) {
+	for _, tc := range []struct{ ref, id, key string }{
+		{"app/db", "app/db", ""},
+		{"app/db:password", "app/db", "password"},
+		{"arn:aws:secretsmanager:us-east-1:123456789012:secret:app/db-AbCdEf", "arn:aws:secretsmanager:us-east-1:123456789012:secret:app/db-AbCdEf", ""},
+		{"arn:aws:secretsmanager:us-east-1:123456789012:secret:app/db-AbCdEf:password", "arn:aws:secretsmanager:us-east-1:123456789012:secret:app/db-AbCdEf", "password"},
+	} {
+		id, key := parseSecretRef(tc.ref)
+		if id != tc.id || key != tc.key {
+			t.Errorf("parseSecretRef(%q) = %q, %q, want %q, %q", tc.ref, id, key, tc.id, tc.key)
+		}
+	}
+}
+
+func Test_jsonField(t *testing.T) {
+	const secret = `{"password":"s3cret","port":5432,"tls":true,"opts":{}}`
+	for key, want := range map[string]string{"password": "s3cret", "port": "5432", "tls": "true"} {
+		got, err := jsonField([]byte(secret), key)
+		if err != nil || got != want {
+			t.Errorf("jsonField(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	for _, key := range []string{"opts", "missing"} {
+		if _, err := jsonField([]byte(secret), key); err == nil {
+			t.Errorf("jsonField(%q) succeeded, want error", key)
+		}
+	}
+}
+
+func Test_printDrifts(t *testing.T) {
+	drifts := []types.StackResourceDrift{
+		{
+			LogicalResourceId:        ptr("Bucket"),
+			ResourceType:             ptr("AWS::S3::Bucket"),
+			StackResourceDriftStatus: types.StackResourceDriftStatusModified,
+			PropertyDifferences: []types.PropertyDifference{
+				{PropertyPath: ptr("/Tags/0/Value")},
+				{PropertyPath: ptr("/VersioningConfiguration")},
+			},
+		},
+		{
+			LogicalResourceId:        ptr("Queue"),
+			ResourceType:             ptr("AWS::SQS::Queue"),
+			StackResourceDriftStatus: types.StackResourceDriftStatusDeleted,
+		},
+	}
+	var buf strings.Builder
+	if err := printDrifts(&buf, drifts); err != nil {
+		t.Fatal(err)
+	}
+	const want = `LOGICAL ID  RESOURCE TYPE    DRIFT STATUS  PROPERTIES
+Bucket      AWS::S3::Bucket  MODIFIED      /Tags/0/Value, /VersioningConfiguration
+Queue       AWS::SQS::Queue  DELETED       -
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_checkAllowedValues(t *testing.T) {
+	decls := map[string]templateParam{
+		"Env":    {allowedValues: []string{"dev", "prod"}},
+		"Secret": {noEcho: true, allowedValues: []string{"a", "b"}},
+		"Free":   {},
+	}
+	noEcho := noEchoParameters(decls)
+	if err := checkAllowedValues(decls, map[string]string{"Env": "prod", "Free": "anything"}, noEcho); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := checkAllowedValues(decls, map[string]string{"Env": "staging", "Secret": "hunter2"}, noEcho)
+	if err == nil {
+		t.Fatal("want error for values not allowed")
+	}
+	if msg := err.Error(); !strings.Contains(msg, `"staging"`) || !strings.Contains(msg, "dev, prod") {
+		t.Errorf("error should mention the value and allowed values: %q", msg)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error leaks NoEcho parameter value: %q", err)
+	}
+}
+
+func Test_updateStackAllowedPattern(t *testing.T) {
+	svc := newFakeCloudFormation()
+	svc.decls = []types.ParameterDeclaration{{ParameterKey: ptr("ImageTag"), ParameterType: ptr("String")}}
+	svc.template = `{"Parameters":{"ImageTag":{"Type":"String","AllowedPattern":"v[0-9]+"}}}`
+	err := updateStack(context.Background(), svc, testOptions(), "my-stack", stackUpdate{params: map[string]string{"ImageTag": "latest"}})
+	if !errors.Is(err, errUsage) || svc.updates != 0 {
+		t.Fatalf("got error %v after %d updates, want usage error before updating", err, svc.updates)
+	}
+}
+
+func Test_checkAllowedPatterns(t *testing.T) {
+	decls := map[string]templateParam{
+		"Name":    {typ: "String", allowedPattern: "[a-z][a-z0-9-]*"},
+		"Subnets": {typ: "CommaDelimitedList", allowedPattern: "subnet-[0-9a-f]+"},
+		"Secret":  {typ: "String", noEcho: true, allowedPattern: "[0-9]{4}"},
+		"Java":    {typ: "String", allowedPattern: "(?=x)x"}, // not supported by RE2
+	}
+	noEcho := noEchoParameters(decls)
+	ok := map[string]string{"Name": "web-1", "Subnets": "subnet-1a, subnet-2b", "Secret": "1234", "Java": "y"}
+	if err := checkAllowedValues(decls, ok, noEcho); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the pattern must match the whole value
+	err := checkAllowedValues(decls, map[string]string{"Name": "Web-1", "Subnets": "subnet-1a,vpc-1", "Secret": "12345"}, noEcho)
+	if err == nil {
+		t.Fatal("want error for values not matching patterns")
+	}
+	for _, want := range []string{`"Web-1" of "Name"`, `"subnet-1a,vpc-1" of "Subnets"`, `value of "Secret" parameter does not match`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %s: %q", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "12345") {
+		t.Errorf("error leaks NoEcho parameter value: %q", err)
+	}
+}
+
+func Test_checkParamTypes(t *testing.T) {
+	decls := map[string]templateParam{
+		"Size":    {typ: "Number"},
+		"Ports":   {typ: "List<Number>"},
+		"Subnets": {typ: "List<AWS::EC2::Subnet::Id>"},
+		"Envs":    {typ: "CommaDelimitedList", allowedValues: []string{"dev", "prod"}},
+	}
+	good := map[string]string{"Size": "1.5", "Ports": "80, 443", "Subnets": "subnet-1,subnet-2", "Envs": "dev,prod"}
+	if err := errors.Join(checkParamTypes(decls, good, map[string]bool{}), checkAllowedValues(decls, good, map[string]bool{})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := checkParamTypes(decls, map[string]string{"Size": "ten", "Ports": "80,http"}, map[string]bool{})
+	if err == nil {
+		t.Fatal("want error for non-numeric values")
+	}
+	for _, s := range []string{`"Size"`, `"Ports"`, `"http"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q should mention %s", err, s)
+		}
+	}
+	if err := checkAllowedValues(decls, map[string]string{"Envs": "dev,staging"}, map[string]bool{}); err == nil {
+		t.Error("want error for a list element that is not allowed")
+	}
+}
+
+type fakeSummarizer struct {
+	calls int
+	out   *cloudformation.GetTemplateSummaryOutput
+}
+
+func (f *fakeSummarizer) GetTemplateSummary(context.Context, *cloudformation.GetTemplateSummaryInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateSummaryOutput, error) {
+	f.calls++
+	return f.out, nil
+}
+
+func Test_templateParameters(t *testing.T) {
+	svc := &fakeSummarizer{out: &cloudformation.GetTemplateSummaryOutput{
+		Parameters: []types.ParameterDeclaration{
+			{ParameterKey: ptr("Env"), ParameterType: ptr("String"), DefaultValue: ptr("dev"),
+				ParameterConstraints: &types.ParameterConstraints{AllowedValues: []string{"dev", "prod"}}},
+			{ParameterKey: ptr("Password"), ParameterType: ptr("String"), NoEcho: ptr(true)},
+			{ParameterKey: ptr("Ports"), ParameterType: ptr("List<Number>")},
+		},
+	}}
+	got, err := templateParameters(context.Background(), svc, templateSummaryInput("my-stack", "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.calls != 1 {
+		t.Errorf("got %d GetTemplateSummary calls, want 1", svc.calls)
+	}
+	want := map[string]templateParam{
+		"Env":      {typ: "String", defaultValue: "dev", allowedValues: []string{"dev", "prod"}},
+		"Password": {typ: "String", noEcho: true},
+		"Ports":    {typ: "List<Number>"},
+	}
+	if !maps.EqualFunc(got, want, func(a, b templateParam) bool {
+		return a.typ == b.typ && a.noEcho == b.noEcho && a.defaultValue == b.defaultValue && slices.Equal(a.allowedValues, b.allowedValues)
+	}) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if noEcho := noEchoParameters(got); !maps.Equal(noEcho, map[string]bool{"Password": true}) {
+		t.Errorf("got NoEcho parameters %v", noEcho)
+	}
+}
+
+func Test_addAllowedPatterns(t *testing.T) {
+	const body = `Parameters:
+  Env:
+    Type: String
+    AllowedPattern: "[a-z]+"
+  Size:
+    Type: Number
+    Default: !Ref AWS::NoValue
+Resources:
+  Queue:
+    Type: AWS::SQS::Queue
+    Properties:
+      QueueName: !Sub "${Env}-queue"
+`
+	decls := map[string]templateParam{"Env": {typ: "String"}, "Size": {typ: "Number"}}
+	svc := newFakeCloudFormation()
+	svc.template = body
+	if err := addAllowedPatterns(context.Background(), svc, decls, "my-stack", ""); err != nil {
+		t.Fatal(err)
+	}
+	if decls["Env"].allowedPattern != "[a-z]+" || decls["Size"].allowedPattern != "" {
+		t.Errorf("got patterns %q and %q", decls["Env"].allowedPattern, decls["Size"].allowedPattern)
+	}
+	decls = map[string]templateParam{"Env": {typ: "String"}}
+	if err := addAllowedPatterns(context.Background(), svc, decls, "my-stack", `{"Parameters":{"Env":{"Type":"String","AllowedPattern":"dev|prod"}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if got := decls["Env"].allowedPattern; got != "dev|prod" {
+		t.Errorf("got pattern %q from JSON template", got)
+	}
+}
+
+func Test_stepSummary(t *testing.T) {
+	stack := &types.Stack{
+		StackName:   ptr("my-stack"),
+		StackStatus: types.StackStatusUpdateComplete,
+		Outputs:     []types.Output{{OutputKey: ptr("Url"), OutputValue: ptr("https://a|b")}},
+	}
+	existing := []types.Parameter{
+		{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+		{ParameterKey: ptr("Password"), ParameterValue: ptr(noEchoMask)},
+		{ParameterKey: ptr("Size"), ParameterValue: ptr("10")},
+		{ParameterKey: ptr("Legacy"), ParameterValue: ptr("yes")},
+	}
+	set := map[string]string{"ImageTag": "v2", "Password": "hunter2", "Size": "10"}
+	var buf strings.Builder
+	// Password is hidden for its masked value, even if not known to be NoEcho
+	stepSummary(&buf, stack, existing, set, map[string]struct{}{"Legacy": {}}, map[string]bool{})
+	const want = "### Stack my-stack\n\n" +
+		"Status: `UPDATE_COMPLETE`\n\n" +
+		"| Parameter | Old value | New value |\n| --- | --- | --- |\n" +
+		"| ImageTag | v1 | v2 |\n" +
+		"| Password | *** | *** |\n" +
+		"| Legacy | yes | _deleted_ |\n" +
+		"\n| Output | Value |\n| --- | --- |\n" +
+		"| Url | https://a\\|b |\n\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_isStackMissing(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "ValidationError", Message: "Stack with id my-stack does not exist"}, true},
+		{fmt.Errorf("describing: %w", &smithy.GenericAPIError{Code: "ValidationError", Message: "Stack with id my-stack does not exist"}), true},
+		{&smithy.GenericAPIError{Code: "ValidationError", Message: "Template format error"}, false},
+		{&smithy.GenericAPIError{Code: "AccessDenied", Message: "does not exist"}, false},
+		{errors.New("Stack with id my-stack does not exist"), false},
+	} {
+		if got := isStackMissing(tc.err); got != tc.want {
+			t.Errorf("isStackMissing(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func Test_updateStackMissing(t *testing.T) {
+	opts := testOptions()
+	opts.Region = "eu-west-1"
+	err := updateStack(context.Background(), newFakeCloudFormation(), opts, "my-stak", stackUpdate{params: map[string]string{"ImageTag": "v2"}})
+	if want := `stack "my-stak" does not exist in region eu-west-1`; err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
+
+func Test_isRootCause(t *testing.T) {
+	for _, tc := range []struct {
+		status types.ResourceStatus
+		reason string
+		want   bool
+	}{
+		{types.ResourceStatusUpdateFailed, "Resource handler returned message: invalid value", true},
+		{types.ResourceStatusUpdateFailed, "Resource update cancelled", false},
+		{types.ResourceStatusCreateFailed, "Bucket already exists", true},
+		{types.ResourceStatusCreateFailed, "Resource creation cancelled", false},
+		{types.ResourceStatusDeleteFailed, "cannot delete", false},
+		{types.ResourceStatusUpdateComplete, "", false},
+	} {
+		evt := types.StackEvent{ResourceStatus: tc.status, ResourceStatusReason: &tc.reason}
+		if got := isRootCause(evt, defaultIgnoredReasons); got != tc.want {
+			t.Errorf("isRootCause(%v, %q) = %v, want %v", tc.status, tc.reason, got, tc.want)
+		}
+	}
+	ignored := []*regexp.Regexp{regexp.MustCompile(`already exists`)}
+	evt := types.StackEvent{ResourceStatus: types.ResourceStatusCreateFailed, ResourceStatusReason: ptr("Bucket already exists")}
+	if isRootCause(evt, ignored) {
+		t.Errorf("failure with reason matching %v reported as a root cause", ignored)
+	}
+	evt = types.StackEvent{ResourceStatus: types.ResourceStatusUpdateFailed, ResourceStatusReason: ptr("Resource update cancelled")}
+	if !isRootCause(evt, nil) {
+		t.Error("with no ignored reasons, cancelled update is not reported as a root cause")
+	}
+}
+
+func Test_stalled(t *testing.T) {
+	now := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	p := progress{
+		"Database":     types.ResourceStatusUpdateInProgress,
+		"Distribution": types.ResourceStatusUpdateInProgress,
+		"Bucket":       types.ResourceStatusUpdateComplete,
+		"Queue":        types.ResourceStatusCreateInProgress,
+	}
+	lastEvent := map[string]time.Time{
+		"Database":     now.Add(-time.Hour),
+		"Distribution": now.Add(-20 * time.Minute),
+		"Bucket":       now.Add(-time.Hour),
+		"Queue":        now.Add(-time.Minute),
+	}
+	got := stalled(p, lastEvent, now, 15*time.Minute)
+	if want := []string{"Database", "Distribution"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// fakeCloudFormation serves a single stack. Once updated, the stack reports
+// events with the given statuses, the last of which is for the stack itself.
+type fakeCloudFormation struct {
+	CloudFormationAPI // not implemented methods panic
+
+	stack    types.Stack
+	decls    []types.ParameterDeclaration
+	statuses []types.ResourceStatus // resource statuses to report after UpdateStack
+	reason   string                 // status reason of the failed events
+	retried  []types.ResourceStatus // if set, replace statuses after the first update
+	badTopic string                 // if set, UpdateStack rejects notification ARNs with it
+	template string                 // current template body
+
+	updated *cloudformation.UpdateStackInput
+	updates int
+
+	changeSet *cloudformation.DescribeChangeSetOutput // reported for any change set name
+	executed  *cloudformation.ExecuteChangeSetInput
+	created   *cloudformation.CreateStackInput
+}
+
+func (f *fakeCloudFormation) DescribeStacks(_ context.Context, in *cloudformation.DescribeStacksInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	if unptr(in.StackName) != unptr(f.stack.StackName) {
+		return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "Stack with id " + unptr(in.StackName) + " does not exist"}
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: []types.Stack{f.stack}}, nil
+}
+
+func (f *fakeCloudFormation) GetTemplate(context.Context, *cloudformation.GetTemplateInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error) {
+	return &cloudformation.GetTemplateOutput{TemplateBody: &f.template}, nil
+}
+
+func (f *fakeCloudFormation) GetTemplateSummary(context.Context, *cloudformation.GetTemplateSummaryInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateSummaryOutput, error) {
+	return &cloudformation.GetTemplateSummaryOutput{Parameters: f.decls}, nil
+}
+
+func (f *fakeCloudFormation) UpdateStack(_ context.Context, in *cloudformation.UpdateStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	if f.updates++; f.updates > 1 && f.retried != nil {
+		f.statuses = f.retried
+	}
+	if f.badTopic != "" && slices.Contains(in.NotificationARNs, f.badTopic) {
+		return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "Notification ARN(s) [" + f.badTopic + "] are invalid"}
+	}
+	f.updated = in
+	return &cloudformation.UpdateStackOutput{StackId: f.stack.StackId}, nil
+}
+
+func (f *fakeCloudFormation) DescribeChangeSet(_ context.Context, in *cloudformation.DescribeChangeSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeChangeSetOutput, error) {
+	if f.changeSet == nil {
+		return nil, &smithy.GenericAPIError{Code: "ChangeSetNotFound", Message: "ChangeSet [" + unptr(in.ChangeSetName) + "] does not exist"}
+	}
+	return f.changeSet, nil
+}
+
+func (f *fakeCloudFormation) ExecuteChangeSet(_ context.Context, in *cloudformation.ExecuteChangeSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error) {
+	f.executed = in
+	// events of the execution are reported the same way as of an update
+	f.updated = &cloudformation.UpdateStackInput{StackName: f.stack.StackName, ClientRequestToken: in.ClientRequestToken}
+	return &cloudformation.ExecuteChangeSetOutput{}, nil
+}
+
+func (f *fakeCloudFormation) CreateStack(_ context.Context, in *cloudformation.CreateStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error) {
+	f.created = in
+	// events of the creation are reported the same way as of an update
+	f.updated = &cloudformation.UpdateStackInput{StackName: in.StackName, ClientRequestToken: in.ClientRequestToken}
+	return &cloudformation.CreateStackOutput{StackId: f.stack.StackId}, nil
+}
+
+func (f *fakeCloudFormation) DescribeStackEvents(context.Context, *cloudformation.DescribeStackEventsInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	if f.updated == nil {
+		return &cloudformation.DescribeStackEventsOutput{}, nil
+	}
+	now := time.Now()
+	var events []types.StackEvent
+	for i, status := range f.statuses {
+		evt := types.StackEvent{
+			EventId:            ptr(fmt.Sprint("event-", i)),
+			ClientRequestToken: f.updated.ClientRequestToken,
+			Timestamp:          &now,
+			ResourceStatus:     status,
+			LogicalResourceId:  ptr(fmt.Sprint("Resource", i)),
+			ResourceType:       ptr("AWS::SQS::Queue"),
+		}
+		if strings.HasSuffix(string(status), "_FAILED") {
+			evt.ResourceStatusReason = &f.reason
+		}
+		if i == len(f.statuses)-1 {
+			evt.LogicalResourceId = f.stack.StackName
+			evt.ResourceType = ptr("AWS::CloudFormation::Stack")
+		}
+		events = append(events, evt)
+	}
+	slices.Reverse(events) // newest first, like the API does
+	return &cloudformation.DescribeStackEventsOutput{StackEvents: events}, nil
+}
+
+func newFakeCloudFormation() *fakeCloudFormation {
+	return &fakeCloudFormation{
+		stack: types.Stack{
+			StackName:   ptr("my-stack"),
+			StackId:     ptr("arn:aws:cloudformation:us-east-1:123456789012:stack/my-stack/1"),
+			StackStatus: types.StackStatusUpdateComplete,
+			Parameters: []types.Parameter{
+				{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+				{ParameterKey: ptr("Size"), ParameterValue: ptr("10")},
+				{ParameterKey: ptr("Legacy"), ParameterValue: ptr("yes")},
+			},
+		},
+		statuses: []types.ResourceStatus{types.ResourceStatusUpdateInProgress, types.ResourceStatusUpdateComplete},
+	}
+}
+
+func testOptions() Options {
+	return Options{
+		StackNames:   []string{"my-stack"},
+		Wait:         true,
+		Timeout:      time.Minute,
+		PollInterval: time.Millisecond,
+		EventsSince:  time.Hour,
+		MaxAttempts:  1,
+	}
+}
+
+func Test_createStackTerminationProtection(t *testing.T) {
+	for _, want := range []*bool{nil, ptr(true), ptr(false)} {
+		svc := newFakeCloudFormation()
+		svc.statuses = []types.ResourceStatus{types.ResourceStatusCreateInProgress, types.ResourceStatusCreateComplete}
+		opts := testOptions()
+		opts.TerminationProtection = want
+		upd := stackUpdate{params: map[string]string{"ImageTag": "v1"}, templateBody: "{}"}
+		if err := createStack(context.Background(), svc, opts, "my-stack", upd); err != nil {
+			t.Fatal(err)
+		}
+		if got := svc.created.EnableTerminationProtection; (got == nil) != (want == nil) || (got != nil && *got != *want) {
+			t.Errorf("created with termination protection %v, want %v", unptr(got), unptr(want))
+		}
+	}
+}
+
+func Test_updateStackMerge(t *testing.T) {
+	svc := newFakeCloudFormation()
+	upd := stackUpdate{
+		params:   map[string]string{"ImageTag": "v2"},
+		toDelete: map[string]struct{}{"Legacy": {}},
+	}
+	if err := updateStack(context.Background(), svc, testOptions(), "my-stack", upd); err != nil {
+		t.Fatal(err)
+	}
+	if svc.updated == nil {
+		t.Fatal("UpdateStack was not called")
+	}
+	want := []types.Parameter{
+		{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v2")},
+		{ParameterKey: ptr("Size"), UsePreviousValue: ptr(true)},
+	}
+	if !slices.EqualFunc(svc.updated.Parameters, want, func(a, b types.Parameter) bool {
+		return unptr(a.ParameterKey) == unptr(b.ParameterKey) && unptr(a.ParameterValue) == unptr(b.ParameterValue) &&
+			unptr(a.UsePreviousValue) == unptr(b.UsePreviousValue)
+	}) {
+		t.Errorf("UpdateStack called with unexpected parameters: %+v", svc.updated.Parameters)
+	}
+}
+
+func Test_updateStackUnknownKey(t *testing.T) {
+	svc := newFakeCloudFormation()
+	upd := stackUpdate{params: map[string]string{"ImageTag": "v2", "Typo": "x"}}
+	err := updateStack(context.Background(), svc, testOptions(), "my-stack", upd)
+	if !errors.Is(err, errUsage) || !strings.Contains(err.Error(), "Typo") {
+		t.Fatalf("got error %v, want usage error naming the unknown key", err)
+	}
+	if !strings.HasSuffix(err.Error(), "valid names are: ImageTag, Legacy, Size") {
+		t.Errorf("error should list valid parameter names: %v", err)
+	}
+	if svc.updated != nil {
+		t.Error("UpdateStack should not be called")
+	}
+}
+
+func Test_updateStackTerminalStates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []types.ResourceStatus
+		wantErr  error
+	}{
+		{"complete", []types.ResourceStatus{types.ResourceStatusUpdateComplete, types.ResourceStatusUpdateComplete}, nil},
+		{"rolled back", []types.ResourceStatus{types.ResourceStatusUpdateFailed, types.ResourceStatusUpdateRollbackComplete}, errUpdateFailed},
+		{"rollback failed", []types.ResourceStatus{types.ResourceStatusUpdateFailed, types.ResourceStatusUpdateRollbackFailed}, errUpdateFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newFakeCloudFormation()
+			svc.statuses = tc.statuses
+			svc.reason = "Queue name is taken"
+			err := updateStack(context.Background(), svc, testOptions(), "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}})
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), "Resource0 UPDATE_FAILED: Queue name is taken") {
+				t.Errorf("error should name the failed resource and reason: %v", err)
+			}
+		})
+	}
+}
+
+// scriptedEvents returns events of polls[:n] on the nth DescribeStackEvents
+// call, as if events of each poll happened after the previous call.
+type scriptedEvents struct {
+	CloudFormationAPI // not implemented methods panic
+
+	polls  [][]types.StackEvent
+	calls  int
+	nested map[string][]types.StackEvent // events of nested stacks by their ids
+}
+
+func (s *scriptedEvents) DescribeStackEvents(_ context.Context, in *cloudformation.DescribeStackEventsInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	if events, ok := s.nested[unptr(in.StackName)]; ok {
+		events = slices.Clone(events)
+		slices.Reverse(events)
+		return &cloudformation.DescribeStackEventsOutput{StackEvents: events}, nil
+	}
+	s.calls = min(s.calls+1, len(s.polls))
+	var events []types.StackEvent
+	for _, poll := range s.polls[:s.calls] {
+		events = append(events, poll...)
+	}
+	events = slices.Clone(events)
+	slices.Reverse(events) // newest first, like the API does
+	return &cloudformation.DescribeStackEventsOutput{StackEvents: events}, nil
+}
+
+// stackEvent returns an event of the my-stack stack, or one of its resources
+// for ids other than the stack name.
+func stackEvent(token, id string, status types.ResourceStatus, reason string) types.StackEvent {
+	now := time.Now()
+	evt := types.StackEvent{
+		EventId:              ptr(token + "/" + id + "/" + string(status)),
+		ClientRequestToken:   &token,
+		Timestamp:            &now,
+		LogicalResourceId:    &id,
+		ResourceType:         ptr("AWS::SQS::Queue"),
+		ResourceStatus:       status,
+		ResourceStatusReason: &reason,
+	}
+	if id == "my-stack" {
+		evt.ResourceType = ptr("AWS::CloudFormation::Stack")
+	}
+	return evt
+}
+
+func Test_waitForUpdate(t *testing.T) {
+	const token = "ucs-test"
+	for _, tc := range []struct {
+		name       string
+		noRollback bool
+		polls      [][]types.StackEvent
+		wantErr    string // empty for success
+	}{
+		{
+			name: "update complete",
+			polls: [][]types.StackEvent{
+				{
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+					stackEvent(token, "Queue", types.ResourceStatusUpdateInProgress, ""),
+				},
+				{
+					stackEvent(token, "Queue", types.ResourceStatusUpdateComplete, ""),
+					stackEvent(token, "my-stack", types.ResourceStatus("UPDATE_COMPLETE_CLEANUP_IN_PROGRESS"), ""),
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateComplete, ""),
+				},
+			},
+		},
+		{
+			name: "rollback complete",
+			polls: [][]types.StackEvent{
+				{
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+					stackEvent(token, "Queue", types.ResourceStatusUpdateFailed, "Queue name is taken"),
+					stackEvent(token, "Topic", types.ResourceStatusUpdateFailed, "Resource update cancelled"),
+				},
+				{
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateRollbackInProgress, "The following resource(s) failed to update: [Queue]"),
+				},
+				{
+					stackEvent(token, "Queue", types.ResourceStatusUpdateComplete, ""),
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateRollbackComplete, ""),
+				},
+			},
+			wantErr: "Queue UPDATE_FAILED: Queue name is taken",
+		},
+		{
+			name:       "resource failure without rollback",
+			noRollback: true,
+			polls: [][]types.StackEvent{
+				{
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+					stackEvent(token, "Queue", types.ResourceStatusUpdateFailed, "Queue name is taken"),
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateFailed, "The following resource(s) failed to update: [Queue]"),
+				},
+			},
+			wantErr: "Queue UPDATE_FAILED: Queue name is taken",
+		},
+		{
+			name: "events of other updates are ignored",
+			polls: [][]types.StackEvent{
+				{
+					stackEvent("ucs-previous", "Queue", types.ResourceStatusUpdateFailed, "Queue name is taken"),
+					stackEvent("ucs-previous", "my-stack", types.ResourceStatusUpdateRollbackComplete, ""),
+				},
+				{
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+					stackEvent(token, "my-stack", types.ResourceStatusUpdateComplete, ""),
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.NoRollback = tc.noRollback
+			svc := &scriptedEvents{polls: tc.polls}
+			err := waitForUpdate(context.Background(), svc, opts, "my-stack", token, time.Time{})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if svc.calls != len(tc.polls) {
+					t.Errorf("finished after %d polls, want %d", svc.calls, len(tc.polls))
+				}
+				return
+			}
+			if !errors.Is(err, errUpdateFailed) {
+				t.Fatalf("got error %v, want update failure", err)
+			}
+			if err.Error() != tc.wantErr {
+				t.Errorf("got error %q, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func Test_updateStackRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		reason      string
+		maxAttempts int
+		wantUpdates int
+		wantErr     bool
+	}{
+		{"transient failure", "The role defined for the function cannot be assumed by Lambda.", 3, 2, false},
+		{"genuine failure", "Queue name is taken", 3, 1, true},
+		{"retries disabled", "The role defined for the function cannot be assumed by Lambda.", 1, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newFakeCloudFormation()
+			svc.statuses = []types.ResourceStatus{types.ResourceStatusUpdateFailed, types.ResourceStatusUpdateRollbackComplete}
+			svc.retried = []types.ResourceStatus{types.ResourceStatusUpdateComplete, types.ResourceStatusUpdateComplete}
+			svc.reason = tc.reason
+			opts := testOptions()
+			opts.MaxAttempts = tc.maxAttempts
+			err := updateStack(context.Background(), svc, opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if svc.updates != tc.wantUpdates {
+				t.Errorf("got %d UpdateStack calls, want %d", svc.updates, tc.wantUpdates)
+			}
+		})
+	}
+}
+
+func Test_updateStackBadNotificationARNs(t *testing.T) {
+	const bad, good = "arn:aws:sns:us-east-1:123456789012:deleted", "arn:aws:sns:us-east-1:123456789012:alerts"
+	for _, tc := range []struct {
+		name     string
+		drop     bool
+		override []string
+		wantErr  bool
+	}{
+		{"dropped", true, nil, false},
+		{"not enabled", false, nil, true},
+		{"set explicitly", true, []string{bad}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newFakeCloudFormation()
+			svc.stack.NotificationARNs = []string{bad, good}
+			svc.badTopic = bad
+			opts := testOptions()
+			opts.DropBadNotificationARNs = tc.drop
+			opts.NotificationARNs = tc.override
+			err := updateStack(context.Background(), svc, opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if svc.updates != 2 {
+				t.Errorf("got %d UpdateStack calls, want 2", svc.updates)
+			}
+			if got := svc.updated.NotificationARNs; !slices.Equal(got, []string{good}) {
+				t.Errorf("updated with notification ARNs %q, want %q", got, good)
+			}
+		})
+	}
+}
+
+func Test_eventsCutoff(t *testing.T) {
+	now := time.Now()
+	svc := newFakeCloudFormation()
+	svc.stack.CreationTime = ptr(now.Add(-48 * time.Hour))
+	svc.stack.LastUpdatedTime = ptr(now.Add(-3 * time.Hour))
+	opts := testOptions()
+	within := func(got, want time.Time) bool { d := got.Sub(want); return -time.Second < d && d < time.Second }
+	if got, want := eventsCutoff(context.Background(), svc, opts, "my-stack", time.Time{}), now.Add(-opts.EventsSince); !within(got, want) {
+		t.Errorf("default cutoff is %v, want %v", got, want)
+	}
+	opts.SinceLastOperation = true
+	if got, want := eventsCutoff(context.Background(), svc, opts, "my-stack", time.Time{}), now.Add(-3*time.Hour-clockSkew); !within(got, want) {
+		t.Errorf("cutoff since last operation is %v, want %v", got, want)
+	}
+	if got, want := eventsCutoff(context.Background(), svc, opts, "my-stack", now), now.Add(-clockSkew); !within(got, want) {
+		t.Errorf("cutoff of a started update is %v, want %v", got, want)
+	}
+	svc.stack.LastUpdatedTime = nil
+	if got, want := eventsCutoff(context.Background(), svc, opts, "my-stack", time.Time{}), now.Add(-48*time.Hour-clockSkew); !within(got, want) {
+		t.Errorf("cutoff of a never updated stack is %v, want %v", got, want)
+	}
+	if got, want := eventsCutoff(context.Background(), svc, opts, "other-stack", time.Time{}), now.Add(-opts.EventsSince); !within(got, want) {
+		t.Errorf("cutoff if the stack cannot be described is %v, want %v", got, want)
+	}
+}
+
+func Test_recordEvents(t *testing.T) {
+	var buf strings.Builder
+	eventsFile.w = &buf
+	defer func() { eventsFile.w = nil }()
+	ts := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	recordEvents("my-stack", []types.StackEvent{
+		{Timestamp: &ts, LogicalResourceId: ptr("Queue"), ResourceType: ptr("AWS::SQS::Queue"),
+			ResourceStatus: types.ResourceStatusUpdateFailed, ResourceStatusReason: ptr("Queue name is taken")},
+		{Timestamp: &ts, LogicalResourceId: ptr("my-stack"), ResourceType: ptr("AWS::CloudFormation::Stack"),
+			ResourceStatus: types.ResourceStatusUpdateComplete},
+	})
+	const want = `{"time":"2024-11-01T12:00:00Z","stack":"my-stack","logicalId":"Queue","resourceType":"AWS::SQS::Queue","status":"UPDATE_FAILED","reason":"Queue name is taken"}
+{"time":"2024-11-01T12:00:00Z","stack":"my-stack","logicalId":"my-stack","resourceType":"AWS::CloudFormation::Stack","status":"UPDATE_COMPLETE"}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_waitForUpdateNested(t *testing.T) {
+	const token, nestedID = "ucs-test", "arn:aws:cloudformation:us-east-1:123456789012:stack/my-stack-Nested-1/2"
+	nestedEvent := func(status types.ResourceStatus, reason string) types.StackEvent {
+		evt := stackEvent(token, "Nested", status, reason)
+		evt.ResourceType = ptr("AWS::CloudFormation::Stack")
+		evt.PhysicalResourceId = ptr(nestedID)
+		return evt
+	}
+	polls := [][]types.StackEvent{
+		{
+			stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+			nestedEvent(types.ResourceStatusUpdateInProgress, ""),
+		},
+		{
+			nestedEvent(types.ResourceStatusUpdateFailed, "Embedded stack "+nestedID+" was not successfully updated"),
+			stackEvent(token, "my-stack", types.ResourceStatusUpdateRollbackInProgress, "The following resource(s) failed to update: [Nested]"),
+			stackEvent(token, "my-stack", types.ResourceStatusUpdateRollbackComplete, ""),
+		},
+	}
+	nested := map[string][]types.StackEvent{nestedID: {
+		stackEvent("ucs-nested", "Database", types.ResourceStatusUpdateFailed, "Instance class is not supported"),
+	}}
+	for _, tc := range []struct {
+		follow  bool
+		wantErr string
+	}{
+		{false, "Nested UPDATE_FAILED: Embedded stack " + nestedID + " was not successfully updated"},
+		{true, "Nested/Database UPDATE_FAILED: Instance class is not supported"},
+	} {
+		opts := testOptions()
+		opts.FollowNested = tc.follow
+		svc := &scriptedEvents{polls: polls, nested: nested}
+		err := waitForUpdate(context.Background(), svc, opts, "my-stack", token, time.Time{})
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("with -follow-nested=%v got error %v, want %q", tc.follow, err, tc.wantErr)
+		}
+	}
+}
+
+func Test_updateStackResume(t *testing.T) {
+	svc := newFakeCloudFormation()
+	// events of the update started by another run
+	svc.updated = &cloudformation.UpdateStackInput{ClientRequestToken: ptr("ucs-started-earlier")}
+	opts := testOptions()
+	opts.ResumeToken = "ucs-started-earlier"
+	if err := updateStack(context.Background(), svc, opts, "my-stack", stackUpdate{empty: true}); err != nil {
+		t.Fatal(err)
+	}
+	if svc.updates != 0 {
+		t.Errorf("UpdateStack was called %d times, want none", svc.updates)
+	}
+	opts.PollInterval = minPollInterval
+	if _, err := prepareUpdate(opts, nil); err != nil {
+		t.Errorf("-resume without parameters: %v", err)
+	}
+	if _, err := prepareUpdate(opts, []string{"ImageTag=v2"}); err == nil {
+		t.Error("-resume with parameters to change should be rejected")
+	}
+}
+
+func Test_hasChanges(t *testing.T) {
+	stack := &types.Stack{
+		Parameters: []types.Parameter{
+			{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+			{ParameterKey: ptr("Password"), ParameterValue: ptr(noEchoMask)},
+		},
+		Tags: []types.Tag{{Key: ptr("env"), Value: ptr("prod")}},
+	}
+	for _, tc := range []struct {
+		name string
+		opts Options
+		upd  stackUpdate
+		want bool
+	}{
+		{"same value", Options{}, stackUpdate{params: map[string]string{"ImageTag": "v1"}}, false},
+		{"new value", Options{}, stackUpdate{params: map[string]string{"ImageTag": "v2"}}, true},
+		{"NoEcho value", Options{}, stackUpdate{params: map[string]string{"Password": "hunter2"}}, true},
+		{"same tag", Options{}, stackUpdate{params: map[string]string{"ImageTag": "v1"}, tags: map[string]string{"env": "prod"}}, false},
+		{"new tag", Options{}, stackUpdate{tags: map[string]string{"env": "dev"}}, true},
+		{"removed tag", Options{TagsToRemove: []string{"env"}}, stackUpdate{}, true},
+		{"deleted parameter", Options{}, stackUpdate{toDelete: map[string]struct{}{"ImageTag": {}}}, true},
+		{"new template", Options{TemplateURL: "https://example.com/t.yml"}, stackUpdate{params: map[string]string{"ImageTag": "v1"}}, true},
+	} {
+		if got := hasChanges(tc.opts, stack, tc.upd); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func Test_presignTemplateURL(t *testing.T) {
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+	}
+	got, err := presignTemplateURL(context.Background(), cfg, "s3://my-bucket/templates/stack.yml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "https://my-bucket.s3.us-east-1.amazonaws.com/templates/stack.yml?") || !strings.Contains(got, "X-Amz-Signature=") {
+		t.Errorf("unexpected presigned URL: %s", got)
+	}
+	for _, bad := range []string{"s3://my-bucket", "s3:///key", "https://my-bucket/key"} {
+		if _, err := presignTemplateURL(context.Background(), cfg, bad, false); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func Test_copyParams(t *testing.T) {
+	source := &types.Stack{
+		StackName: ptr("staging"),
+		Parameters: []types.Parameter{
+			{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v2")},
+			{ParameterKey: ptr("Size"), ParameterValue: ptr("2")},
+			{ParameterKey: ptr("Password"), ParameterValue: ptr(noEchoMask)},
+			{ParameterKey: ptr("Legacy"), ParameterValue: ptr("yes")},
+			{ParameterKey: ptr("StagingOnly"), ParameterValue: ptr("x")},
+		},
+	}
+	target := &types.Stack{
+		Parameters: []types.Parameter{
+			{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+			{ParameterKey: ptr("Size"), ParameterValue: ptr("10")},
+			{ParameterKey: ptr("Password"), ParameterValue: ptr(noEchoMask)},
+			{ParameterKey: ptr("Legacy"), ParameterValue: ptr("no")},
+		},
+	}
+	got := copyParams("prod", source, target, map[string]string{"Size": "20"}, map[string]struct{}{"Legacy": {}})
+	if want := map[string]string{"ImageTag": "v2", "Size": "20"}; !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func Test_resourceTimings(t *testing.T) {
+	start := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	rt := make(resourceTimings)
+	for _, evt := range []struct {
+		id     string
+		status types.ResourceStatus
+		after  time.Duration
+	}{
+		{"Queue", types.ResourceStatusUpdateInProgress, 0},
+		{"Database", types.ResourceStatusUpdateInProgress, time.Second},
+		{"Queue", types.ResourceStatusUpdateComplete, 30 * time.Second},
+		{"Topic", types.ResourceStatusUpdateInProgress, 40 * time.Second},
+		{"Database", types.ResourceStatusUpdateComplete, 10 * time.Minute},
+	} {
+		ts := start.Add(evt.after)
+		rt.add(types.StackEvent{LogicalResourceId: &evt.id, ResourceStatus: evt.status, Timestamp: &ts})
+	}
+	var buf strings.Builder
+	rt.print(&buf)
+	const want = "LOGICAL ID  DURATION\nDatabase    9m59s\nQueue       30s\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_confirm(t *testing.T) {
+	for input, want := range map[string]bool{
+		"y\n":    true,
+		"YES\n":  true,
+		"yes":    true,
+		"n\n":    false,
+		"\n":     false,
+		"sure\n": false,
+	} {
+		var out strings.Builder
+		got, err := confirm(strings.NewReader(input), &out, "Apply these changes?")
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+		if got != want {
+			t.Errorf("%q: got %v, want %v", input, got, want)
+		}
+		if out.String() != "Apply these changes? [y/N] " {
+			t.Errorf("unexpected prompt: %q", out.String())
+		}
+	}
+	if _, err := confirm(strings.NewReader(""), io.Discard, "Apply?"); err == nil {
+		t.Error("want error on closed input")
+	}
+}
+
+func Test_updateStackNewTemplate(t *testing.T) {
+	svc := newFakeCloudFormation()
+	svc.decls = []types.ParameterDeclaration{
+		{ParameterKey: ptr("ImageTag"), ParameterType: ptr("String")},
+		{ParameterKey: ptr("Size"), ParameterType: ptr("Number")},
+		{ParameterKey: ptr("Replicas"), ParameterType: ptr("Number")},
+	}
+	upd := stackUpdate{
+		params:       map[string]string{"ImageTag": "v2", "Replicas": "3"},
+		templateBody: "{}",
+	}
+	if err := updateStack(context.Background(), svc, testOptions(), "my-stack", upd); err != nil {
+		t.Fatal(err)
+	}
+	if svc.updated == nil {
+		t.Fatal("UpdateStack was not called")
+	}
+	// Legacy is not declared in the new template, Replicas is only
+	// declared there
+	want := []types.Parameter{
+		{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v2")},
+		{ParameterKey: ptr("Size"), UsePreviousValue: ptr(true)},
+		{ParameterKey: ptr("Replicas"), ParameterValue: ptr("3")},
+	}
+	if !slices.EqualFunc(svc.updated.Parameters, want, func(a, b types.Parameter) bool {
+		return unptr(a.ParameterKey) == unptr(b.ParameterKey) && unptr(a.ParameterValue) == unptr(b.ParameterValue) &&
+			unptr(a.UsePreviousValue) == unptr(b.UsePreviousValue)
+	}) {
+		t.Errorf("UpdateStack called with unexpected parameters: %+v", svc.updated.Parameters)
+	}
+
+	upd.params = map[string]string{"Legacy": "no"}
+	err := updateStack(context.Background(), svc, testOptions(), "my-stack", upd)
+	if !errors.Is(err, errUsage) || !strings.Contains(err.Error(), "Legacy") {
+		t.Fatalf("got error %v, want usage error naming the parameter the new template doesn't declare", err)
+	}
+}
+
+func Test_deployOutputs(t *testing.T) {
+	defer func(v bool) { underGithub = v }(underGithub)
+	underGithub = true
+	for _, tc := range []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{"updated", map[string]string{"ImageTag": "v2"}, "QueueURL=https://sqs.example.com/queue\nupdated=true\nstatus=UPDATE_COMPLETE\n"},
+		{"unchanged", map[string]string{"ImageTag": "v1"}, "QueueURL=https://sqs.example.com/queue\nupdated=false\nstatus=UPDATE_COMPLETE\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "output")
+			t.Setenv("GITHUB_OUTPUT", name)
+			t.Setenv("GITHUB_STEP_SUMMARY", "")
+			opts := testOptions()
+			opts.OnlyIfChanged = true
+			svc := newFakeCloudFormation()
+			svc.stack.Outputs = []types.Output{{OutputKey: ptr("QueueURL"), OutputValue: ptr("https://sqs.example.com/queue")}}
+			err := deploy(context.Background(), svc, opts, stackUpdate{params: tc.params})
+			if err != nil && !isNoUpdates(err) {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != tc.want {
+				t.Errorf("got outputs:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func Test_closestName(t *testing.T) {
+	names := []string{"ImageTag", "InstanceType", "Size", "VpcId"}
+	for _, tc := range []struct{ name, want string }{
+		{"InstanceTypes", "InstanceType"},
+		{"instancetype", "InstanceType"},
+		{"ImagTag", "ImageTag"},
+		{"Sizes", "Size"},
+		{"Vpc", ""}, // too short to guess two characters
+		{"Typo", ""},
+		{"Subnets", ""},
+	} {
+		if got := closestName(tc.name, names); got != tc.want {
+			t.Errorf("closestName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func Test_editDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"InstanceType", "InstanceTypes", 1},
+		{"flaw", "lawn", 2},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func Test_yamlParams(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		want    []string
+		ok      bool
+		wantErr bool
+	}{
+		{"lines", "ImageTag=v2\nSize=10\n", nil, false, false},
+		{"line with colon", "Desc=note: this is a value", nil, false, false},
+		{"yaml", "ImageTag: v2\nVersion: 1.10\nEnabled: true\nCert: '@cert.pem'\n",
+			[]string{"ImageTag=v2", "Version=1.10", "Enabled=true", "Cert=@@cert.pem"}, true, false},
+		{"json", `{"ImageTag": "v2", "Size": 10}`, []string{"ImageTag=v2", "Size=10"}, true, false},
+		{"null", "Empty:\n", []string{"Empty="}, true, false},
+		{"nested", "Tags:\n  - a\n", nil, false, true},
+		{"empty", "", nil, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok, err := yamlParams(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tc.ok || !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func Test_formatEvent(t *testing.T) {
+	defer func(t *template.Template) { eventTemplate = t }(eventTemplate)
+	ts := time.Date(2024, 5, 1, 12, 30, 45, 0, time.UTC)
+	evt := types.StackEvent{
+		Timestamp:            &ts,
+		LogicalResourceId:    ptr("Queue"),
+		ResourceType:         ptr("AWS::SQS::Queue"),
+		ResourceStatus:       types.ResourceStatusUpdateFailed,
+		ResourceStatusReason: ptr("Queue name is taken"),
+	}
+	for _, tc := range []struct{ format, want string }{
+		{"default", "AWS::SQS::Queue\tQueue\tUPDATE_FAILED"},
+		{"short", "Queue\tUPDATE_FAILED"},
+		{"long", "12:30:45\tAWS::SQS::Queue\tQueue\tUPDATE_FAILED\tQueue name is taken"},
+		{"{{.Status}} {{.LogicalID}}: {{.Reason}}", "UPDATE_FAILED Queue: Queue name is taken"},
+	} {
+		if err := setEventFormat(tc.format); err != nil {
+			t.Fatal(err)
+		}
+		if got := formatEvent(evt); got != tc.want {
+			t.Errorf("format %q: got %q, want %q", tc.format, got, tc.want)
+		}
+	}
+	for _, format := range []string{"{{.Status", "{{.Unknown}}"} {
+		if err := setEventFormat(format); err == nil {
+			t.Errorf("format %q should be rejected", format)
+		}
+	}
+}
+
+func Test_waitForUpdateInitialDelay(t *testing.T) {
+	svc := newFakeCloudFormation()
+	opts := testOptions()
+	opts.InitialDelay = 50 * time.Millisecond
+	begin := time.Now()
+	if err := updateStack(context.Background(), svc, opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(begin); d < opts.InitialDelay {
+		t.Errorf("update completed in %v, before the initial delay of %v", d, opts.InitialDelay)
+	}
+}
+
+func Test_waitForUpdateFirstPoll(t *testing.T) {
+	svc := newFakeCloudFormation()
+	svc.statuses = []types.ResourceStatus{types.ResourceStatusUpdateComplete}
+	opts := testOptions()
+	opts.PollInterval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := updateStack(ctx, svc, opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}}); err != nil {
+		t.Fatalf("update completed on the first poll should not wait for the poll interval: %v", err)
+	}
+}
+
+func Test_describeEvents(t *testing.T) {
+	svc := &scriptedEvents{polls: [][]types.StackEvent{{
+		stackEvent("other", "my-stack", types.ResourceStatusUpdateInProgress, ""),
+		stackEvent("other", "my-stack", types.ResourceStatusUpdateComplete, ""),
+		stackEvent("ours", "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+		stackEvent("ours", "Queue", types.ResourceStatusUpdateFailed, "Queue name is taken"),
+		stackEvent("ours", "my-stack", types.ResourceStatusUpdateRollbackComplete, ""),
+		stackEvent("later", "my-stack", types.ResourceStatusUpdateInProgress, ""),
+	}}}
+	var buf strings.Builder
+	if err := describeEvents(context.Background(), svc, &buf, "my-stack", "ours"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("want header and 3 events, got:\n%s", buf.String())
+	}
+	for i, want := range []string{"UPDATE_IN_PROGRESS", "Queue name is taken", "UPDATE_ROLLBACK_COMPLETE"} {
+		if !strings.Contains(lines[i+1], want) {
+			t.Errorf("line %d should contain %q: %q", i+1, want, lines[i+1])
+		}
+	}
+	if err := describeEvents(context.Background(), svc, &buf, "my-stack", "unknown"); err == nil {
+		t.Error("unknown token should be reported")
+	}
+}
+
+func Test_checkAllowedParams(t *testing.T) {
+	allowed := []string{"ImageTag", "Replicas"}
+	if err := checkAllowedParams(allowed, map[string]string{"ImageTag": "v2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := checkAllowedParams(allowed, map[string]string{"ImageTag": "v2", "Size": "20"}, map[string]struct{}{"Legacy": {}})
+	if err == nil || !strings.HasSuffix(err.Error(), "not allowed: Legacy, Size") {
+		t.Fatalf("got error %v, want one naming Legacy and Size", err)
+	}
+	if err := checkAllowedParams([]string{}, map[string]string{"ImageTag": "v2"}, nil); err == nil {
+		t.Error("empty allowlist should not allow any changes")
+	}
+}
+
+func Test_updateStackRequireAllParams(t *testing.T) {
+	svc := newFakeCloudFormation()
+	opts := testOptions()
+	opts.RequireAllParams = true
+	err := updateStack(context.Background(), svc, opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}})
+	if !errors.Is(err, errUsage) || !strings.HasSuffix(err.Error(), "these are not: Legacy, Size") {
+		t.Fatalf("got error %v, want usage error naming parameters not set", err)
+	}
+	upd := stackUpdate{
+		params:   map[string]string{"ImageTag": "v2", "Size": "20"},
+		toDelete: map[string]struct{}{"Legacy": {}},
+	}
+	if err := updateStack(context.Background(), svc, opts, "my-stack", upd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateStackParameters(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	svc := newFakeCloudFormation()
+	svc.stack.Outputs = []types.Output{{OutputKey: ptr("QueueURL"), OutputValue: ptr("https://sqs.example.com/queue")}}
+	opts := DefaultOptions()
+	opts.StackNames = []string{"my-stack"}
+	opts.PollInterval = minPollInterval
+	opts.Parameters = map[string]string{"ImageTag": "@v2"} // taken as is
+	// the fake client has no options to take the region from
+	if _, err := UpdateStackParameters(context.Background(), svc, opts); !errors.Is(err, errUsage) {
+		t.Fatalf("got error %v without a region, want usage error", err)
+	}
+	opts.Region = "us-east-1"
+	opts.TemplateURL = "s3://bucket/template.yaml"
+	if _, err := UpdateStackParameters(context.Background(), svc, opts); !errors.Is(err, errUsage) {
+		t.Fatalf("got error %v for an s3:// template URL, want usage error", err)
+	}
+	opts.TemplateURL = ""
+	for _, mod := range []func(*Options){
+		func(o *Options) { o.Parameters = map[string]string{"DbPassword": "ssm:/db/pass"} },
+		func(o *Options) { o.LiteralParams = []string{"ApiKey=secretsmanager:api-key"} },
+		func(o *Options) { o.ParamsFile = "params.txt" },
+		func(o *Options) { o.ExpandEnv = true },
+	} {
+		o := opts
+		mod(&o)
+		if _, err := UpdateStackParameters(context.Background(), svc, o); !errors.Is(err, errUsage) {
+			t.Errorf("got error %v, want usage error", err)
+		}
+	}
+	if svc.updates != 0 {
+		t.Fatalf("stack was updated with rejected options")
+	}
+	res, err := UpdateStackParameters(context.Background(), svc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Updated || res.Status != types.StackStatusUpdateComplete || res.Outputs["QueueURL"] != "https://sqs.example.com/queue" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if p := svc.updated.Parameters[0]; unptr(p.ParameterKey) != "ImageTag" || unptr(p.ParameterValue) != "@v2" {
+		t.Errorf("unexpected parameter: %s=%s", unptr(p.ParameterKey), unptr(p.ParameterValue))
+	}
+}
+
+func Test_waitForUpdateDeadline(t *testing.T) {
+	const token = "ucs-test"
+	svc := &scriptedEvents{polls: [][]types.StackEvent{{
+		stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+	}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := waitForUpdate(ctx, svc, testOptions(), "my-stack", token, time.Now())
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("got error %v, want %v", err, errInterrupted)
+	}
+	// the update is left running, so there must be a way to get back to it
+	if !strings.Contains(err.Error(), "-stack=my-stack -resume="+token) {
+		t.Errorf("error should tell how to resume waiting: %v", err)
+	}
+}
+
+func Test_waitForUpdateCanceled(t *testing.T) {
+	const token = "ucs-test"
+	// CancelUpdateStack is not implemented, so the update must be left running
+	svc := &scriptedEvents{polls: [][]types.StackEvent{{
+		stackEvent(token, "my-stack", types.ResourceStatusUpdateInProgress, "User Initiated"),
+	}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := waitForUpdate(ctx, svc, testOptions(), "my-stack", token, time.Now())
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("got error %v, want %v", err, errInterrupted)
+	}
+	if !strings.Contains(err.Error(), "-stack=my-stack -resume="+token) {
+		t.Errorf("error should tell how to resume waiting: %v", err)
+	}
+}
+
+// creatingStack reports the stack as being created; CancelUpdateStack is not
+// implemented, as creations cannot be cancelled.
+type creatingStack struct {
+	scriptedEvents
+}
+
+func (c *creatingStack) DescribeStacks(context.Context, *cloudformation.DescribeStacksInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	return &cloudformation.DescribeStacksOutput{Stacks: []types.Stack{{StackName: ptr("my-stack"), StackStatus: types.StackStatusCreateInProgress}}}, nil
+}
+
+func Test_waitForUpdateInterruptCreate(t *testing.T) {
+	const token = "ucs-test"
+	svc := &creatingStack{scriptedEvents{polls: [][]types.StackEvent{{
+		stackEvent(token, "my-stack", types.ResourceStatusCreateInProgress, "User Initiated"),
+	}}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	opts := testOptions()
+	opts.CancelOnInterrupt = true
+	err := waitForUpdate(ctx, svc, opts, "my-stack", token, time.Now())
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("got error %v, want %v", err, errInterrupted)
+	}
+	if !strings.Contains(err.Error(), "being created") || !strings.Contains(err.Error(), "-resume="+token) {
+		t.Errorf("error should tell the creation is left running and how to resume waiting: %v", err)
+	}
+}
+
+type fakeStackSet struct {
+	stackSetAPI // not implemented methods panic
+
+	set     types.StackSet
+	status  types.StackSetOperationStatus
+	results []types.StackSetOperationResultSummary
+	updated *cloudformation.UpdateStackSetInput
+}
+
+func (f *fakeStackSet) DescribeStackSet(context.Context, *cloudformation.DescribeStackSetInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackSetOutput, error) {
+	return &cloudformation.DescribeStackSetOutput{StackSet: &f.set}, nil
+}
+
+func (f *fakeStackSet) UpdateStackSet(_ context.Context, in *cloudformation.UpdateStackSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.UpdateStackSetOutput, error) {
+	f.updated = in
+	return &cloudformation.UpdateStackSetOutput{OperationId: in.OperationId}, nil
+}
+
+func (f *fakeStackSet) DescribeStackSetOperation(context.Context, *cloudformation.DescribeStackSetOperationInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackSetOperationOutput, error) {
+	return &cloudformation.DescribeStackSetOperationOutput{StackSetOperation: &types.StackSetOperation{Status: f.status}}, nil
+}
+
+func (f *fakeStackSet) ListStackSetOperationResults(context.Context, *cloudformation.ListStackSetOperationResultsInput, ...func(*cloudformation.Options)) (*cloudformation.ListStackSetOperationResultsOutput, error) {
+	return &cloudformation.ListStackSetOperationResultsOutput{Summaries: f.results}, nil
+}
+
+func Test_updateStackSet(t *testing.T) {
+	newSvc := func(status types.StackSetOperationStatus) *fakeStackSet {
+		return &fakeStackSet{
+			set: types.StackSet{
+				StackSetName:      ptr("my-set"),
+				Capabilities:      []types.Capability{types.CapabilityCapabilityIam},
+				ExecutionRoleName: ptr("CustomExecutionRole"),
+				Parameters: []types.Parameter{
+					{ParameterKey: ptr("ImageTag"), ParameterValue: ptr("v1")},
+					{ParameterKey: ptr("Size"), ParameterValue: ptr("10")},
+				},
+			},
+			status: status,
+		}
+	}
+	opts := testOptions()
+	opts.StackSet = true
+	opts.ClientRequestToken = "op-1"
+
+	svc := newSvc(types.StackSetOperationStatusSucceeded)
+	if err := updateStackSet(context.Background(), svc, opts, "my-set", stackUpdate{params: map[string]string{"ImageTag": "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	in := svc.updated
+	if !unptr(in.UsePreviousTemplate) || unptr(in.OperationId) != "op-1" || unptr(in.ExecutionRoleName) != "CustomExecutionRole" {
+		t.Errorf("unexpected update input: %+v", in)
+	}
+	if !slices.Equal(in.Capabilities, []types.Capability{types.CapabilityCapabilityIam}) {
+		t.Errorf("got capabilities %v, want stack set ones", in.Capabilities)
+	}
+	if len(in.Parameters) != 2 || unptr(in.Parameters[0].ParameterValue) != "v2" || !unptr(in.Parameters[1].UsePreviousValue) {
+		t.Errorf("unexpected parameters: %+v", in.Parameters)
+	}
+
+	svc = newSvc(types.StackSetOperationStatusSucceeded)
+	err := updateStackSet(context.Background(), svc, opts, "my-set", stackUpdate{params: map[string]string{"ImageTg": "v2"}})
+	if exitCode(err) != exitUsage || svc.updated != nil {
+		t.Fatalf("got error %v, want usage error without update", err)
+	}
+
+	svc = newSvc(types.StackSetOperationStatusFailed)
+	svc.results = []types.StackSetOperationResultSummary{
+		{Account: ptr("123456789012"), Region: ptr("us-east-1"), Status: types.StackSetOperationResultStatusSucceeded},
+		{Account: ptr("123456789012"), Region: ptr("eu-west-1"), Status: types.StackSetOperationResultStatusFailed, StatusReason: ptr("bad value")},
+	}
+	err = updateStackSet(context.Background(), svc, opts, "my-set", stackUpdate{params: map[string]string{"Size": "20"}})
+	if exitCode(err) != exitUpdateFailed {
+		t.Fatalf("got error %v, want update failure", err)
+	}
+	failures, err := stackSetFailures(context.Background(), svc, "my-set", "op-1")
+	if err != nil || len(failures) != 1 || unptr(failures[0].Region) != "eu-west-1" {
+		t.Errorf("got failures %+v, %v", failures, err)
+	}
+}
+
+func Test_checkStackSetOptions(t *testing.T) {
+	opts := testOptions()
+	opts.StackSet = true
+	opts.TokenPrefix = defaultTokenPrefix
+	if err := checkStackSetOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ token, prefix string }{{"1-token", defaultTokenPrefix}, {"", "1-"}, {"", ""}} {
+		o := opts
+		o.ClientRequestToken, o.TokenPrefix = tc.token, tc.prefix
+		if err := checkStackSetOptions(o); err == nil {
+			t.Errorf("token %q, prefix %q: got no error for an operation id not starting with a letter", tc.token, tc.prefix)
+		}
+	}
+	opts.DryRun, opts.NoRollback, opts.FollowNested, opts.MaxAttempts = true, true, true, 3
+	want := "these flags cannot be used with -stack-set: -dry-run, -follow-nested, -max-attempts, -no-rollback"
+	if err := checkStackSetOptions(opts); err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+}
+
+func Test_readResourcesToImport(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content string
+		wantErr bool
+	}{
+		{`[{"ResourceType":"AWS::S3::Bucket","LogicalResourceId":"Bucket","ResourceIdentifier":{"BucketName":"my-bucket"}}]`, false},
+		{`[{"ResourceType":"AWS::S3::Bucket","LogicalResourceId":"Bucket"}]`, true},
+		{`[]`, true},
+		{`{"ResourceType":"AWS::S3::Bucket"}`, true},
+	} {
+		name := filepath.Join(dir, "resources.json")
+		if err := os.WriteFile(name, []byte(tc.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readResourcesToImport(name)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.content, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (len(got) != 1 || got[0].ResourceIdentifier["BucketName"] != "my-bucket") {
+			t.Errorf("%s: got %+v", tc.content, got)
+		}
+	}
+}
+
+func Test_changeSetInput(t *testing.T) {
+	input := &cloudformation.UpdateStackInput{StackName: ptr("my-stack"), TemplateBody: ptr("{}")}
+	if got := changeSetInput(input, "dry-run", nil); got.ChangeSetType != types.ChangeSetTypeUpdate || got.ResourcesToImport != nil {
+		t.Errorf("got %v change set with resources %v, want an update one", got.ChangeSetType, got.ResourcesToImport)
+	}
+	resources := []types.ResourceToImport{{
+		ResourceType:       ptr("AWS::S3::Bucket"),
+		LogicalResourceId:  ptr("Bucket"),
+		ResourceIdentifier: map[string]string{"BucketName": "my-bucket"},
+	}}
+	got := changeSetInput(input, "import", resources)
+	if got.ChangeSetType != types.ChangeSetTypeImport || len(got.ResourcesToImport) != 1 || unptr(got.TemplateBody) != "{}" {
+		t.Errorf("unexpected import change set input: %+v", got)
+	}
+}
+
+func Test_capabilitiesError(t *testing.T) {
+	apiErr := &smithy.GenericAPIError{Code: "InsufficientCapabilitiesException", Message: "Requires capabilities : [CAPABILITY_NAMED_IAM]"}
+	err := capabilitiesError(apiErr, []types.Capability{types.CapabilityCapabilityAutoExpand})
+	if exitCode(err) != exitUsage || !errors.Is(err, apiErr) {
+		t.Fatalf("got error %v, want usage error wrapping the API one", err)
+	}
+	if want := "run with -capabilities=CAPABILITY_AUTO_EXPAND,CAPABILITY_NAMED_IAM"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+	other := &smithy.GenericAPIError{Code: "ValidationError", Message: "Template format error"}
+	if err := capabilitiesError(other, nil); err != other {
+		t.Errorf("got %v, want the original error", err)
+	}
+	if err := capabilitiesError(nil, nil); err != nil {
+		t.Errorf("got %v for nil error", err)
+	}
+}
+
+func Test_describeChangeSet(t *testing.T) {
+	svc := newFakeCloudFormation()
+	svc.changeSet = &cloudformation.DescribeChangeSetOutput{
+		ChangeSetName:   ptr("review-1"),
+		ChangeSetId:     ptr("arn:aws:cloudformation:us-east-1:123456789012:changeSet/review-1/1"),
+		StackName:       ptr("my-stack"),
+		Status:          types.ChangeSetStatusCreateComplete,
+		ExecutionStatus: types.ExecutionStatusAvailable,
+		Changes: []types.Change{{ResourceChange: &types.ResourceChange{
+			Action:            types.ChangeActionModify,
+			LogicalResourceId: ptr("Service"),
+			ResourceType:      ptr("AWS::ECS::Service"),
+			Replacement:       types.ReplacementFalse,
+		}}},
+	}
+	var buf strings.Builder
+	if err := describeChangeSet(context.Background(), svc, &buf, "my-stack", "review-1"); err != nil {
+		t.Fatal(err)
+	}
+	want := `Change set:        review-1
+Stack:             my-stack
+Status:            CREATE_COMPLETE
+Execution status:  AVAILABLE
+
+ACTION  LOGICAL ID  RESOURCE TYPE      REPLACEMENT
+Modify  Service     AWS::ECS::Service  False
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_executeChangeSet(t *testing.T) {
+	newSvc := func(status types.ExecutionStatus) *fakeCloudFormation {
+		svc := newFakeCloudFormation()
+		svc.changeSet = &cloudformation.DescribeChangeSetOutput{
+			ChangeSetName:   ptr("review-1"),
+			ChangeSetId:     ptr("arn:aws:cloudformation:us-east-1:123456789012:changeSet/review-1/1"),
+			StackName:       ptr("my-stack"),
+			Status:          types.ChangeSetStatusCreateComplete,
+			ExecutionStatus: status,
+		}
+		return svc
+	}
+	opts := testOptions()
+	opts.ExecuteChangeSet = "review-1"
+	opts.ClientRequestToken = "apply-1"
+	upd := stackUpdate{empty: true}
+
+	svc := newSvc(types.ExecutionStatusAvailable)
+	if err := updateStack(context.Background(), svc, opts, "my-stack", upd); err != nil {
+		t.Fatal(err)
+	}
+	if svc.executed == nil || unptr(svc.executed.ChangeSetName) != unptr(svc.changeSet.ChangeSetId) || unptr(svc.executed.ClientRequestToken) != "apply-1" {
+		t.Errorf("unexpected ExecuteChangeSet input: %+v", svc.executed)
+	}
+
+	svc = newSvc(types.ExecutionStatusExecuteComplete)
+	if err := updateStack(context.Background(), svc, opts, "my-stack", upd); err == nil || svc.executed != nil {
+		t.Fatalf("got error %v, executed: %v; want an error without execution", err, svc.executed != nil)
+	}
+
+	opts.PollInterval = minPollInterval
+	if _, err := prepareUpdate(opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prepareUpdate(opts, []string{"ImageTag=v2"}); err == nil {
+		t.Error("prepareUpdate accepted parameters together with -execute-change-set")
+	}
+}
+
+func Test_expandEnv(t *testing.T) {
+	env := map[string]string{"GIT_SHA": "abc123", "EMPTY": ""}
+	lookup := func(name string) (string, bool) { v, ok := env[name]; return v, ok }
+	got, err := expandEnv([]string{"ImageTag=${GIT_SHA}", "Name=app-$GIT_SHA", "Price=$$5", "Note=${EMPTY}", "Eq=a=$GIT_SHA"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ImageTag=abc123", "Name=app-abc123", "Price=$5", "Note=", "Eq=a=abc123"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	_, err = expandEnv([]string{"ImageTag=${GIT_SHA}", "A=$UNSET_ONE", "B=${UNSET_ONE}-${UNSET_TWO}"}, lookup)
+	if want := "parameter values refer to environment variables that are not set: UNSET_ONE, UNSET_TWO"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+// concurrencyCounter tracks how many stacks are described at once, and
+// reports all of them as missing.
+type concurrencyCounter struct {
+	CloudFormationAPI
+	mu       sync.Mutex
+	cur, max int
+	calls    int
+}
+
+func (c *concurrencyCounter) DescribeStacks(_ context.Context, in *cloudformation.DescribeStacksInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	c.mu.Lock()
+	c.cur++
+	c.calls++
+	c.max = max(c.max, c.cur)
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.cur--
+	c.mu.Unlock()
+	return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "Stack with id " + unptr(in.StackName) + " does not exist"}
+}
+
+func Test_updateStacksMaxConcurrent(t *testing.T) {
+	opts := testOptions()
+	opts.StackNames = []string{"a", "b", "c", "d", "e", "f"}
+	opts.IfExists = true
+	opts.MaxConcurrent = 2
+	svc := &concurrencyCounter{}
+	if err := updateStacks(context.Background(), svc, opts, stackUpdate{}); err != nil {
+		t.Fatal(err)
+	}
+	if svc.calls != len(opts.StackNames) || svc.max != 2 {
+		t.Errorf("got %d stacks updated with at most %d at once, want %d with at most 2", svc.calls, svc.max, len(opts.StackNames))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	svc = &concurrencyCounter{}
+	err := updateStacks(ctx, svc, opts, stackUpdate{})
+	if err == nil || !errors.Is(err, context.Canceled) || svc.calls != 0 {
+		t.Errorf("got error %v with %d stacks updated, want cancellation with none", err, svc.calls)
+	}
+}
+
+// replayClient serves API responses recorded by apiRecorder, in the order
+// they were recorded for each operation; once they are used up, the last one
+// is repeated. Event timestamps are shifted as if the recording started when
+// the replay did.
+type replayClient struct {
+	CloudFormationAPI // not recorded methods panic
+
+	calls map[string][]fixtureCall
+	shift time.Duration
+}
+
+func loadFixture(t *testing.T, name string) *replayClient {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fix fixture
+	if err := json.Unmarshal(b, &fix); err != nil {
+		t.Fatal(err)
+	}
+	c := &replayClient{calls: make(map[string][]fixtureCall), shift: time.Since(fix.Start)}
+	for _, call := range fix.Calls {
+		c.calls[call.Op] = append(c.calls[call.Op], call)
+	}
+	return c
+}
+
+func (c *replayClient) next(op string, out any) error {
+	calls := c.calls[op]
+	if len(calls) == 0 {
+		return fmt.Errorf("no recorded %s calls", op)
+	}
+	if len(calls) > 1 {
+		c.calls[op] = calls[1:]
+	}
+	if e := calls[0].Error; e != nil {
+		return &smithy.GenericAPIError{Code: e.Code, Message: e.Message}
+	}
+	return json.Unmarshal(calls[0].Output, out)
+}
+
+func (c *replayClient) DescribeStacks(context.Context, *cloudformation.DescribeStacksInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	out := new(cloudformation.DescribeStacksOutput)
+	return out, c.next("DescribeStacks", out)
+}
+
+func (c *replayClient) GetTemplateSummary(context.Context, *cloudformation.GetTemplateSummaryInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateSummaryOutput, error) {
+	out := new(cloudformation.GetTemplateSummaryOutput)
+	return out, c.next("GetTemplateSummary", out)
+}
+
+func (c *replayClient) GetTemplate(context.Context, *cloudformation.GetTemplateInput, ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error) {
+	out := new(cloudformation.GetTemplateOutput)
+	return out, c.next("GetTemplate", out)
+}
+
+func (c *replayClient) UpdateStack(context.Context, *cloudformation.UpdateStackInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	out := new(cloudformation.UpdateStackOutput)
+	return out, c.next("UpdateStack", out)
+}
+
+func (c *replayClient) DescribeStackEvents(context.Context, *cloudformation.DescribeStackEventsInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	out := new(cloudformation.DescribeStackEventsOutput)
+	if err := c.next("DescribeStackEvents", out); err != nil {
+		return nil, err
+	}
+	for i := range out.StackEvents {
+		if ts := out.StackEvents[i].Timestamp; ts != nil {
+			out.StackEvents[i].Timestamp = ptr(ts.Add(c.shift))
+		}
+	}
+	return out, nil
+}
+
+func Test_replayUpdate(t *testing.T) {
+	opts := testOptions()
+	opts.StackNames = []string{"web"}
+	opts.ClientRequestToken = "replay-token" // the one recorded events have
+	upd := stackUpdate{params: map[string]string{"ImageTag": "v2"}}
+
+	if err := deploy(context.Background(), loadFixture(t, filepath.Join("testdata", "update-success.json")), opts, upd); err != nil {
+		t.Fatalf("replaying successful update: %v", err)
+	}
+
+	err := deploy(context.Background(), loadFixture(t, filepath.Join("testdata", "update-rollback.json")), opts, upd)
+	if exitCode(err) != exitUpdateFailed {
+		t.Fatalf("replaying rolled back update: got error %v, want update failure", err)
+	}
+	if want := "Service UPDATE_FAILED: Resource handler returned message"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not report the root cause %q", err, want)
+	}
+}
+
+func Test_apiRecorder(t *testing.T) {
+	svc := newFakeCloudFormation()
+	rec := newAPIRecorder(svc)
+	opts := testOptions()
+	opts.ClientRequestToken = "recorded-token"
+	if err := updateStack(context.Background(), rec, opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "fixture.json")
+	if err := rec.save(name); err != nil {
+		t.Fatal(err)
+	}
+	// replaying the recording goes through the same update again
+	if err := updateStack(context.Background(), loadFixture(t, name), opts, "my-stack", stackUpdate{params: map[string]string{"ImageTag": "v2"}}); err != nil {
+		t.Fatalf("replaying recorded update: %v", err)
+	}
+}
+
+func Test_readParamsFileStdin(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want map[string]string
+	}{
+		{"# generated\nImageTag=v2\nSize=20\n", map[string]string{"ImageTag": "v2", "Size": "20"}},
+		{`{"ImageTag": "v2", "Size": 20}`, map[string]string{"ImageTag": "v2", "Size": "20"}},
+	} {
+		name := filepath.Join(t.TempDir(), "stdin")
+		if err := os.WriteFile(name, []byte(tc.body), 0666); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdin := os.Stdin
+		os.Stdin = f
+		lines, err := readParamsFile("-")
+		os.Stdin = stdin
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseKvs(lines, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.body, got, tc.want)
+		}
+	}
+}
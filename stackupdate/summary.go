@@ -0,0 +1,62 @@
+package stackupdate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// summaryMu serializes writes to the GitHub step summary file when multiple
+// stacks are updated concurrently
+var summaryMu sync.Mutex
+
+// appendStepSummary appends the markdown summary of the stack update to the
+// GitHub Actions job summary file.
+func appendStepSummary(name string, stack *types.Stack, existing []types.Parameter, set map[string]string, toDelete map[string]struct{}, noEcho map[string]bool) error {
+	var b strings.Builder
+	stepSummary(&b, stack, existing, set, toDelete, noEcho)
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, b.String()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// stepSummary writes a markdown summary of the stack update to w: parameter
+// changes with NoEcho values redacted, the stack status, and its outputs.
+func stepSummary(w io.Writer, stack *types.Stack, existing []types.Parameter, set map[string]string, toDelete map[string]struct{}, noEcho map[string]bool) {
+	fmt.Fprintf(w, "### Stack %s\n\n", mdEscape(unptr(stack.StackName)))
+	fmt.Fprintf(w, "Status: `%v`\n\n", stack.StackStatus)
+	fmt.Fprint(w, "| Parameter | Old value | New value |\n| --- | --- | --- |\n")
+	noEcho = withMaskedParams(noEcho, existing)
+	for _, p := range existing {
+		k, old := unptr(p.ParameterKey), unptr(p.ParameterValue)
+		if _, ok := toDelete[k]; ok {
+			fmt.Fprintf(w, "| %s | %s | _deleted_ |\n", mdEscape(k), mdEscape(redact(noEcho, k, old)))
+			continue
+		}
+		if v, ok := set[k]; ok && v != old {
+			fmt.Fprintf(w, "| %s | %s | %s |\n", mdEscape(k), mdEscape(redact(noEcho, k, old)), mdEscape(redact(noEcho, k, v)))
+		}
+	}
+	if len(stack.Outputs) != 0 {
+		fmt.Fprint(w, "\n| Output | Value |\n| --- | --- |\n")
+		for _, o := range stack.Outputs {
+			fmt.Fprintf(w, "| %s | %s |\n", mdEscape(unptr(o.OutputKey)), mdEscape(unptr(o.OutputValue)))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// mdEscape makes s safe to use in a markdown table cell
+var mdEscape = strings.NewReplacer("|", `\|`, "\r", "", "\n", "<br>", "<", "&lt;", ">", "&gt;").Replace